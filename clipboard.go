@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clipboard is where local clipboard content is read from and written to.
+// Images are always exchanged as PNG.
+type Clipboard interface {
+	Name() string
+	ReadText() ([]byte, error)
+	ReadImage() ([]byte, error)
+	WriteText(data []byte) error
+	WriteImage(png []byte) error
+}
+
+// Backends that are told about clipboard changes implement clipboardWatcher.
+// Watch signals whenever the clipboard may have changed until ctx is done.
+// Spurious signals are fine, the content hash filters them out.
+type clipboardWatcher interface {
+	Watch(ctx context.Context) <-chan struct{}
+}
+
+// Returned by backends that cannot handle a content type
+var errUnsupported = errors.New("not supported by this clipboard backend")
+
+// Backend names accepted by the clipboard setting
+const (
+	backendAuto        = "auto"
+	backendSystem      = "system"
+	backendWlClipboard = "wl-clipboard"
+	backendXclip       = "xclip"
+	backendXsel        = "xsel"
+	backendMemory      = "memory"
+	backendFile        = "file"
+)
+
+var clipboardBackends = []string{backendAuto, backendSystem, backendWlClipboard, backendXclip, backendXsel, backendMemory, backendFile}
+
+// Channel signalled when the local clipboard may have changed. Backends
+// without change notifications are checked every poll interval instead.
+func watchClipboard(ctx context.Context, cb Clipboard) <-chan struct{} {
+	if w, ok := cb.(clipboardWatcher); ok {
+		return w.Watch(ctx)
+	}
+	return pollClipboard(ctx, time.Duration(config.PollInterval))
+}
+
+func pollClipboard(ctx context.Context, interval time.Duration) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				signalChange(changes)
+			}
+		}
+	}()
+	return changes
+}
+
+// Signal without blocking, a pending signal already covers this change
+func signalChange(changes chan struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
+
+// Hash identifying clipboard content, used to detect changes and duplicates
+func contentHash(mime string, data []byte) string {
+	sum := sha256.Sum256(append([]byte(mime+"\x00"), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create the configured clipboard backend. "auto" picks the native
+// library where it works and falls back to command-line tools on Linux.
+func newClipboard(name, file string) (Clipboard, error) {
+	switch name {
+	case backendSystem:
+		return newSystemClipboard()
+	case backendWlClipboard, backendXclip, backendXsel:
+		return newCommandClipboard(name)
+	case backendMemory:
+		return newMemoryClipboard(), nil
+	case backendFile:
+		return newFileClipboard(file)
+	case backendAuto:
+		return autoClipboard()
+	default:
+		return nil, fmt.Errorf("unknown clipboard backend %q", name)
+	}
+}
+
+func autoClipboard() (Clipboard, error) {
+	if runtime.GOOS != "linux" {
+		return newSystemClipboard()
+	}
+
+	// The native library only speaks X11, prefer wl-clipboard on Wayland
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		if cb, err := newCommandClipboard(backendWlClipboard); err == nil {
+			return cb, nil
+		}
+	}
+	if cb, err := newSystemClipboard(); err == nil {
+		return cb, nil
+	}
+	for _, name := range []string{backendXclip, backendXsel} {
+		if cb, err := newCommandClipboard(name); err == nil {
+			return cb, nil
+		}
+	}
+	return nil, fmt.Errorf("no clipboard available, install wl-clipboard, xclip or xsel, or set the clipboard backend to memory or file")
+}
+
+// In-memory clipboard, for tests and machines without any clipboard
+type memoryClipboard struct {
+	mu       sync.Mutex
+	text     []byte
+	image    []byte
+	watchers []chan struct{}
+}
+
+func newMemoryClipboard() *memoryClipboard {
+	return &memoryClipboard{}
+}
+
+func (m *memoryClipboard) Name() string { return backendMemory }
+
+func (m *memoryClipboard) ReadText() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]byte(nil), m.text...), nil
+}
+
+func (m *memoryClipboard) ReadImage() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]byte(nil), m.image...), nil
+}
+
+// Like a real clipboard, writing one type replaces the other
+func (m *memoryClipboard) WriteText(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.text, m.image = append([]byte(nil), data...), nil
+	m.notify()
+	return nil
+}
+
+func (m *memoryClipboard) WriteImage(png []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.text, m.image = nil, append([]byte(nil), png...)
+	m.notify()
+	return nil
+}
+
+func (m *memoryClipboard) Watch(ctx context.Context) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	m.mu.Lock()
+	m.watchers = append(m.watchers, changes)
+	m.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.watchers = slices.DeleteFunc(m.watchers, func(c chan struct{}) bool { return c == changes })
+	}()
+	return changes
+}
+
+// The caller must hold m.mu
+func (m *memoryClipboard) notify() {
+	for _, changes := range m.watchers {
+		signalChange(changes)
+	}
+}
+
+// Clipboard kept as files in a directory: clipboard.txt or clipboard.png.
+// Lets scripts on a headless machine exchange clips by reading and writing
+// those files.
+type fileClipboard struct {
+	dir string
+}
+
+func newFileClipboard(dir string) (*fileClipboard, error) {
+	if dir == "" {
+		configured, err := configDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(configured, "clipboard")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create clipboard directory: %v", err)
+	}
+	return &fileClipboard{dir: dir}, nil
+}
+
+func (f *fileClipboard) Name() string { return backendFile + " (" + f.dir + ")" }
+
+func (f *fileClipboard) ReadText() ([]byte, error)  { return f.read("clipboard.txt") }
+func (f *fileClipboard) ReadImage() ([]byte, error) { return f.read("clipboard.png") }
+
+func (f *fileClipboard) WriteText(data []byte) error {
+	return f.write("clipboard.txt", "clipboard.png", data)
+}
+
+func (f *fileClipboard) WriteImage(png []byte) error {
+	return f.write("clipboard.png", "clipboard.txt", png)
+}
+
+// Check the modification times of the files, so content is only read once
+// something was written
+func (f *fileClipboard) Watch(ctx context.Context) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.PollInterval))
+		defer ticker.Stop()
+		last := f.modTimes()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if current := f.modTimes(); current != last {
+					last = current
+					signalChange(changes)
+				}
+			}
+		}
+	}()
+	return changes
+}
+
+func (f *fileClipboard) modTimes() [2]time.Time {
+	var times [2]time.Time
+	for i, name := range []string{"clipboard.txt", "clipboard.png"} {
+		if info, err := os.Stat(filepath.Join(f.dir, name)); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
+
+func (f *fileClipboard) read(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(f.dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Write one file and remove the other, so only one type is ever present
+func (f *fileClipboard) write(name, other string, data []byte) error {
+	if err := writeFileAtomic(filepath.Join(f.dir, name), data); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(f.dir, other)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Check that the tools of a command backend are installed
+func requireCommands(names ...string) error {
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			return fmt.Errorf("%s is not installed", name)
+		}
+	}
+	return nil
+}
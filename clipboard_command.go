@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// How long a clipboard tool may take before it is considered stuck
+	clipboardCommandTimeout = 5 * time.Second
+
+	// How long to wait for output after a tool exited. A child it forked may
+	// keep its stdout and stderr open.
+	clipboardOutputDelay = 200 * time.Millisecond
+)
+
+// Clipboard backed by command-line tools: wl-clipboard on Wayland, xclip
+// or xsel on X11. xsel cannot handle images.
+type commandClipboard struct {
+	name       string
+	readText   []string
+	readImage  []string
+	writeText  []string
+	writeImage []string
+	watch      []string // Prints a line on every change, nil if the tools cannot watch
+}
+
+func newCommandClipboard(name string) (*commandClipboard, error) {
+	var c *commandClipboard
+	switch name {
+	case backendWlClipboard:
+		c = &commandClipboard{
+			name:       name,
+			readText:   []string{"wl-paste", "--no-newline", "--type", "text/plain"},
+			readImage:  []string{"wl-paste", "--type", "image/png"},
+			writeText:  []string{"wl-copy", "--type", "text/plain"},
+			writeImage: []string{"wl-copy", "--type", "image/png"},
+			watch:      []string{"wl-paste", "--watch", "echo"},
+		}
+	case backendXclip:
+		c = &commandClipboard{
+			name:       name,
+			readText:   []string{"xclip", "-selection", "clipboard", "-out"},
+			readImage:  []string{"xclip", "-selection", "clipboard", "-target", "image/png", "-out"},
+			writeText:  []string{"xclip", "-selection", "clipboard", "-in"},
+			writeImage: []string{"xclip", "-selection", "clipboard", "-target", "image/png", "-in"},
+		}
+	case backendXsel:
+		c = &commandClipboard{
+			name:      name,
+			readText:  []string{"xsel", "--clipboard", "--output"},
+			writeText: []string{"xsel", "--clipboard", "--input"},
+		}
+	default:
+		return nil, fmt.Errorf("unknown clipboard command backend %q", name)
+	}
+
+	if err := requireCommands(c.readText[0], c.writeText[0]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *commandClipboard) Name() string { return c.name }
+
+func (c *commandClipboard) ReadText() ([]byte, error) {
+	data, err := c.run(c.readText, nil)
+	if emptySelection(err) {
+		return nil, nil // Empty, or it holds only an image
+	}
+	return data, err
+}
+
+func (c *commandClipboard) ReadImage() ([]byte, error) {
+	if c.readImage == nil {
+		return nil, nil
+	}
+	data, err := c.run(c.readImage, nil)
+	if emptySelection(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// What the tools print when they exit because the clipboard holds nothing of
+// the type asked for
+var emptySelectionMessages = []string{
+	"Nothing is copied",                  // wl-paste, empty clipboard
+	"No selection",                       // wl-paste, older versions
+	"No suitable type of content copied", // wl-paste, only other types
+	"Error: target ",                     // xclip, "Error: target STRING not available"
+}
+
+// Whether a tool failed only because there is nothing of the type asked for,
+// which is not an error here. Any other failure, like no display to connect
+// to, is.
+func emptySelection(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	for _, msg := range emptySelectionMessages {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *commandClipboard) WriteText(data []byte) error {
+	_, err := c.run(c.writeText, data)
+	return err
+}
+
+func (c *commandClipboard) WriteImage(png []byte) error {
+	if c.writeImage == nil {
+		return errUnsupported
+	}
+	_, err := c.run(c.writeImage, png)
+	return err
+}
+
+// Follow the output of the watch command. X11 tools cannot watch, and if
+// the watch command dies the clipboard is polled instead.
+func (c *commandClipboard) Watch(ctx context.Context) <-chan struct{} {
+	interval := time.Duration(config.PollInterval)
+	if c.watch == nil {
+		return pollClipboard(ctx, interval)
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		cmd := exec.CommandContext(ctx, c.watch[0], c.watch[1:]...)
+		stdout, err := cmd.StdoutPipe()
+		if err == nil {
+			err = cmd.Start()
+		}
+		if err == nil {
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				signalChange(changes)
+			}
+			err = cmd.Wait()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		fmt.Printf("[WARN] %s stopped watching the clipboard (%v), polling instead\n", c.watch[0], err)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				signalChange(changes)
+			}
+		}
+	}()
+	return changes
+}
+
+// Run a clipboard tool, feeding it stdin and returning its stdout
+func (c *commandClipboard) run(args []string, stdin []byte) ([]byte, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.WaitDelay = clipboardOutputDelay
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	// wl-copy and xclip fork to keep serving the selection, so only wait for
+	// the process we started, not for the child holding on to its output,
+	// and never forever
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s failed: %v", args[0], err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil && !errors.Is(err, exec.ErrWaitDelay) {
+			return nil, fmt.Errorf("%s failed: %w %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+	case <-time.After(clipboardCommandTimeout):
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("%s timed out", args[0])
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"golang.design/x/clipboard"
+)
+
+// Native clipboard through golang.design/x/clipboard. On Linux it needs X11.
+type systemClipboard struct{}
+
+func newSystemClipboard() (*systemClipboard, error) {
+	if err := clipboard.Init(); err != nil {
+		return nil, fmt.Errorf("failed to initialize clipboard: %v", err)
+	}
+	return &systemClipboard{}, nil
+}
+
+func (systemClipboard) Name() string { return backendSystem }
+
+func (systemClipboard) ReadText() ([]byte, error) {
+	return clipboard.Read(clipboard.FmtText), nil
+}
+
+func (systemClipboard) ReadImage() ([]byte, error) {
+	return clipboard.Read(clipboard.FmtImage), nil
+}
+
+func (systemClipboard) WriteText(data []byte) error {
+	return systemWrite(clipboard.FmtText, data)
+}
+
+func (systemClipboard) WriteImage(png []byte) error {
+	return systemWrite(clipboard.FmtImage, png)
+}
+
+// The library watches each format separately, merge both into one signal
+func (systemClipboard) Watch(ctx context.Context) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	text := clipboard.Watch(ctx, clipboard.FmtText)
+	image := clipboard.Watch(ctx, clipboard.FmtImage)
+	go func() {
+		for text != nil || image != nil {
+			select {
+			case _, ok := <-text:
+				if !ok {
+					text = nil
+					continue
+				}
+			case _, ok := <-image:
+				if !ok {
+					image = nil
+					continue
+				}
+			}
+			signalChange(changes)
+		}
+	}()
+	return changes
+}
+
+// The library reports a failed write by returning no change channel. The
+// channel itself only fires once someone else overwrites the clipboard, so
+// it is not waited on.
+func systemWrite(format clipboard.Format, data []byte) error {
+	if clipboard.Write(format, data) == nil {
+		return fmt.Errorf("failed to write clipboard")
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Put fake clipboard tools, given as shell scripts by name, first on PATH
+func fakeClipboardTools(t *testing.T, scripts map[string]string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake clipboard tools are shell scripts")
+	}
+	dir := t.TempDir()
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestCommandClipboardReadsImagesWithoutText(t *testing.T) {
+	fakeClipboardTools(t, map[string]string{
+		// wl-paste fails for a type the clipboard does not hold
+		"wl-paste": `case "$*" in *image/png*) printf 'PNGDATA' ;; *) echo "No suitable type of content copied" >&2; exit 1 ;; esac`,
+		"wl-copy":  `cat > /dev/null`,
+	})
+	cb, err := newCommandClipboard(backendWlClipboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := cb.ReadText()
+	if err != nil || text != nil {
+		t.Fatalf("ReadText returned %q, %v for a clipboard without text", text, err)
+	}
+
+	s := newServer(cb)
+	if mime, data := s.readClipboard(); mime != mimePNG || string(data) != "PNGDATA" {
+		t.Fatalf("read %s %q, want the image", mime, data)
+	}
+}
+
+func TestCommandClipboardWritesWithForkingTools(t *testing.T) {
+	fakeClipboardTools(t, map[string]string{
+		// Like xclip, a child keeps serving the selection with the output open
+		"xclip": `cat > /dev/null; sleep 3 & exit 0`,
+	})
+	cb, err := newCommandClipboard(backendXclip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := cb.WriteText([]byte("copied")); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("write waited %s for the forked child", elapsed)
+	}
+}
+
+func TestCommandClipboardRoundTrip(t *testing.T) {
+	// Keeps the selection in files, one per target, like a clipboard owner would
+	store := t.TempDir()
+	fakeClipboardTools(t, map[string]string{
+		"xclip": fmt.Sprintf(`f=%s/text; case "$*" in *image/png*) f=%s/png ;; esac
+case "$*" in *-in*) rm -f %s/text %s/png; cat > "$f" ;; *) cat "$f" 2>/dev/null || { echo "Error: target STRING not available" >&2; exit 1; } ;; esac`, store, store, store, store),
+	})
+	cb, err := newCommandClipboard(backendXclip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := cb.ReadText(); err != nil || text != nil {
+		t.Fatalf("empty clipboard read as %q, %v", text, err)
+	}
+	if err := cb.WriteText([]byte("from the PC")); err != nil {
+		t.Fatal(err)
+	}
+	if text, err := cb.ReadText(); err != nil || string(text) != "from the PC" {
+		t.Fatalf("read %q, %v", text, err)
+	}
+	if err := cb.WriteImage([]byte("PNGDATA")); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := cb.ReadImage(); err != nil || string(img) != "PNGDATA" {
+		t.Fatalf("read image %q, %v", img, err)
+	}
+	if text, _ := cb.ReadText(); text != nil {
+		t.Fatalf("text %q kept next to the image", text)
+	}
+}
+
+func TestCommandClipboardErrors(t *testing.T) {
+	fakeClipboardTools(t, map[string]string{
+		"xsel": `echo "Can't open display" >&2; exit 1`,
+	})
+
+	// xsel cannot handle images at all
+	cb, err := newCommandClipboard(backendXsel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img, err := cb.ReadImage(); err != nil || img != nil {
+		t.Fatalf("xsel read image %q, %v", img, err)
+	}
+	if err := cb.WriteImage([]byte("PNGDATA")); !errors.Is(err, errUnsupported) {
+		t.Fatalf("xsel wrote an image: %v", err)
+	}
+
+	// A tool that fails to write reports why
+	err = cb.WriteText([]byte("lost"))
+	if err == nil || !strings.Contains(err.Error(), "Can't open display") {
+		t.Fatalf("failed write returned %v", err)
+	}
+
+	// Tools that are not installed are reported before they are needed
+	t.Setenv("PATH", t.TempDir())
+	if _, err := newCommandClipboard(backendWlClipboard); err == nil || !strings.Contains(err.Error(), "not installed") {
+		t.Fatalf("missing wl-clipboard returned %v", err)
+	}
+	if _, err := newClipboard("magic", ""); err == nil {
+		t.Fatal("unknown backend created")
+	}
+}
+
+func TestFileClipboard(t *testing.T) {
+	saved := config.PollInterval
+	t.Cleanup(func() { config.PollInterval = saved })
+	config.PollInterval = Duration(10 * time.Millisecond)
+
+	dir := filepath.Join(t.TempDir(), "clipboard")
+	cb, err := newClipboard(backendFile, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := cb.ReadText(); err != nil || text != nil {
+		t.Fatalf("empty clipboard read as %q, %v", text, err)
+	}
+
+	// Writing one type replaces the other
+	if err := cb.WriteText([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.WriteImage([]byte("PNGDATA")); err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := cb.ReadText(); text != nil {
+		t.Fatalf("text %q kept next to the image", text)
+	}
+	if img, err := cb.ReadImage(); err != nil || string(img) != "PNGDATA" {
+		t.Fatalf("read image %q, %v", img, err)
+	}
+
+	// A script writing the file is noticed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := watchClipboard(ctx, cb)
+	time.Sleep(30 * time.Millisecond) // Let the watcher note the current files
+	if err := os.WriteFile(filepath.Join(dir, "clipboard.txt"), []byte("from a script"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("change to the file not noticed")
+	}
+	if text, _ := cb.ReadText(); string(text) != "from a script" {
+		t.Fatalf("read %q", text)
+	}
+}
+
+func TestCommandClipboardReportsFailures(t *testing.T) {
+	fakeClipboardTools(t, map[string]string{
+		"wl-paste": `echo "Failed to connect to a Wayland server" >&2; exit 1`,
+		"wl-copy":  `cat > /dev/null`,
+	})
+	cb, err := newCommandClipboard(backendWlClipboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a display the clipboard is not empty, it cannot be read
+	if _, err := cb.ReadText(); err == nil || !strings.Contains(err.Error(), "Wayland") {
+		t.Fatalf("failed read returned %v", err)
+	}
+	if _, err := cb.ReadImage(); err == nil {
+		t.Fatal("failed image read reported an empty clipboard")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clips stamped further ahead of the local clock than this are restamped on
+// arrival, so one device with a wrong clock cannot win every conflict
+const maxClockSkew = 5 * time.Minute
+
+// Timestamp of a hybrid logical clock: physical Unix milliseconds plus a
+// counter that orders events within the same millisecond
+type Timestamp struct {
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical"`
+}
+
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%d.%d", t.Wall, t.Logical)
+}
+
+// Compare two timestamps, returning -1, 0 or 1
+func (t Timestamp) compare(o Timestamp) int {
+	switch {
+	case t.Wall < o.Wall:
+		return -1
+	case t.Wall > o.Wall:
+		return 1
+	case t.Logical < o.Logical:
+		return -1
+	case t.Logical > o.Logical:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Hybrid logical clock (Kulkarni et al.). Timestamps follow physical time
+// but never go backwards and always order after any timestamp received.
+type hybridClock struct {
+	mu       sync.Mutex
+	last     Timestamp
+	physical func() int64 // Unix milliseconds
+}
+
+func newHybridClock() *hybridClock {
+	return &hybridClock{physical: func() int64 { return time.Now().UnixMilli() }}
+}
+
+// Timestamp for a local event
+func (c *hybridClock) Now() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pt := c.physical(); pt > c.last.Wall {
+		c.last = Timestamp{Wall: pt}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Merge a received timestamp, so later local events order after it
+func (c *hybridClock) Update(remote Timestamp) Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pt := c.physical()
+	switch {
+	case pt > c.last.Wall && pt > remote.Wall:
+		c.last = Timestamp{Wall: pt}
+	case remote.Wall > c.last.Wall:
+		c.last = Timestamp{Wall: remote.Wall, Logical: remote.Logical + 1}
+	case c.last.Wall > remote.Wall:
+		c.last.Logical++
+	default:
+		c.last.Logical = max(c.last.Logical, remote.Logical) + 1
+	}
+	return c.last
+}
+
+// Whether a received timestamp is too far ahead of the local clock to trust
+func (c *hybridClock) tooFarAhead(remote Timestamp) bool {
+	return remote.Wall-c.physical() > maxClockSkew.Milliseconds()
+}
+
+// The version of a clip used for last-writer-wins: the clock decides, and
+// the origin breaks ties so every node picks the same winner
+type clipVersion struct {
+	Clock  Timestamp
+	Origin string
+}
+
+func (v clipVersion) newerThan(o clipVersion) bool {
+	if c := v.Clock.compare(o.Clock); c != 0 {
+		return c > 0
+	}
+	return v.Origin > o.Origin
+}
+
+func (v clipVersion) String() string {
+	return v.Clock.String() + "@" + v.Origin
+}
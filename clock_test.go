@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// A clock whose physical time the test controls
+func newTestClock(now *int64) *hybridClock {
+	return &hybridClock{physical: func() int64 { return *now }}
+}
+
+func TestHybridClockNeverGoesBack(t *testing.T) {
+	now := int64(1000)
+	c := newTestClock(&now)
+
+	prev := c.Now()
+	steps := []int64{1000, 1000, 1005, 990, 990, 2000}
+	for _, pt := range steps {
+		now = pt
+		ts := c.Now()
+		if ts.compare(prev) <= 0 {
+			t.Fatalf("at physical time %d got %s after %s", pt, ts, prev)
+		}
+		prev = ts
+	}
+	if prev != (Timestamp{Wall: 2000}) {
+		t.Fatalf("clock did not catch up with physical time, got %s", prev)
+	}
+}
+
+func TestHybridClockOrdersAfterReceived(t *testing.T) {
+	now := int64(1000)
+	c := newTestClock(&now)
+
+	tests := []struct {
+		name   string
+		remote Timestamp
+	}{
+		{"remote ahead", Timestamp{Wall: 1500, Logical: 3}},
+		{"remote equal", Timestamp{Wall: 1500, Logical: 7}},
+		{"remote behind", Timestamp{Wall: 900}},
+	}
+	for _, tt := range tests {
+		before := c.Now()
+		got := c.Update(tt.remote)
+		if got.compare(tt.remote) <= 0 || got.compare(before) <= 0 {
+			t.Fatalf("%s: update to %s gave %s, last was %s", tt.name, tt.remote, got, before)
+		}
+		if next := c.Now(); next.compare(got) <= 0 {
+			t.Fatalf("%s: local event %s not after %s", tt.name, next, got)
+		}
+	}
+}
+
+func TestHybridClockDistrustsFarFuture(t *testing.T) {
+	now := int64(1_000_000)
+	c := newTestClock(&now)
+
+	if c.tooFarAhead(Timestamp{Wall: now + maxClockSkew.Milliseconds()}) {
+		t.Fatal("timestamp at the skew limit rejected")
+	}
+	if !c.tooFarAhead(Timestamp{Wall: now + maxClockSkew.Milliseconds() + 1}) {
+		t.Fatal("timestamp beyond the skew limit accepted")
+	}
+}
+
+func TestClipVersionTieBreak(t *testing.T) {
+	ts := Timestamp{Wall: 1000, Logical: 2}
+	a := clipVersion{Clock: ts, Origin: "a"}
+	b := clipVersion{Clock: ts, Origin: "b"}
+	if !b.newerThan(a) || a.newerThan(b) {
+		t.Fatal("equal clocks must be ordered by origin")
+	}
+	if a.newerThan(a) {
+		t.Fatal("a version is not newer than itself")
+	}
+	later := clipVersion{Clock: Timestamp{Wall: 1000, Logical: 3}, Origin: "a"}
+	if !later.newerThan(b) {
+		t.Fatal("the clock must decide before the origin")
+	}
+}
+
+// A node of the simulated network: the PC hub or a device
+type simNode struct {
+	id      string
+	now     int64 // Physical clock, skewed per node
+	clock   *hybridClock
+	current clipVersion
+	content string
+}
+
+// A clip in flight on a link
+type simClip struct {
+	version clipVersion
+	content string
+}
+
+// Copies on several devices and the PC interleave with deliveries in random
+// order, each link delivering in order like a WebSocket. The hub relays what
+// it applies and drops what loses, as the server does. Once every link is
+// drained, all nodes must hold the newest clip created.
+func TestLastWriterWinsConverges(t *testing.T) {
+	for seed := int64(0); seed < 200; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			simulateConflicts(t, rand.New(rand.NewSource(seed)))
+		})
+	}
+}
+
+func simulateConflicts(t *testing.T, r *rand.Rand) {
+	nodes := make([]*simNode, 4) // nodes[0] is the hub
+	for i := range nodes {
+		n := &simNode{id: fmt.Sprintf("node-%d", i), now: 1000 + r.Int63n(50)}
+		n.clock = newTestClock(&n.now)
+		nodes[i] = n
+	}
+	// links[from][to], only between the hub and devices
+	links := make([][][]simClip, len(nodes))
+	for i := range links {
+		links[i] = make([][]simClip, len(nodes))
+	}
+	send := func(from, to int, clip simClip) {
+		links[from][to] = append(links[from][to], clip)
+	}
+	receive := func(to, from int, clip simClip) {
+		n := nodes[to]
+		n.clock.Update(clip.version.Clock)
+		if !clip.version.newerThan(n.current) {
+			return
+		}
+		n.current, n.content = clip.version, clip.content
+		if to != 0 {
+			return
+		}
+		for i := 1; i < len(nodes); i++ {
+			if i != from {
+				send(0, i, clip)
+			}
+		}
+	}
+
+	// Links with clips in flight
+	pendingLinks := func() [][2]int {
+		var pending [][2]int
+		for from := range links {
+			for to := range links[from] {
+				if len(links[from][to]) > 0 {
+					pending = append(pending, [2]int{from, to})
+				}
+			}
+		}
+		return pending
+	}
+	deliver := func(link [2]int) {
+		from, to := link[0], link[1]
+		clip := links[from][to][0]
+		links[from][to] = links[from][to][1:]
+		receive(to, from, clip)
+	}
+
+	var newest clipVersion
+	var newestContent string
+	for step := 0; step < 60; step++ {
+		for _, n := range nodes {
+			n.now += r.Int63n(3) // Often within the same millisecond
+		}
+
+		pending := pendingLinks()
+		if len(pending) == 0 || r.Intn(3) == 0 {
+			// A local copy
+			i := r.Intn(len(nodes))
+			n := nodes[i]
+			n.current = clipVersion{Clock: n.clock.Now(), Origin: n.id}
+			n.content = fmt.Sprintf("copied on %s at step %d", n.id, step)
+			clip := simClip{version: n.current, content: n.content}
+			if n.current.newerThan(newest) {
+				newest, newestContent = n.current, n.content
+			}
+			if i == 0 {
+				for j := 1; j < len(nodes); j++ {
+					send(0, j, clip)
+				}
+			} else {
+				send(i, 0, clip)
+			}
+			continue
+		}
+
+		deliver(pending[r.Intn(len(pending))])
+	}
+
+	// Drain every link in a random order
+	for {
+		pending := pendingLinks()
+		if len(pending) == 0 {
+			break
+		}
+		deliver(pending[r.Intn(len(pending))])
+	}
+
+	for _, n := range nodes {
+		if n.current != newest || n.content != newestContent {
+			t.Fatalf("%s settled on %s %q, want %s %q", n.id, n.current, n.content, newest, newestContent)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	configFile = "config.json"
+
+	// Prefix of the environment variables overriding the config file
+	envPrefix = "CLIPY_"
+)
+
+// Config holds every user-adjustable setting. Values come from the defaults,
+// then the config file, then CLIPY_* environment variables, then flags.
+type Config struct {
+	Port          int      `json:"port"`
+	QRPort        int      `json:"qrPort"`
+	BindAddress   string   `json:"bindAddress"` // Empty to use the detected Wi-Fi address
+	SaveDir       string   `json:"saveDir"`
+	Notifications bool     `json:"notifications"`
+	PollInterval  Duration `json:"pollInterval"`
+	MaxPayload    int64    `json:"maxPayload"` // Bytes
+	HistoryLimit  int      `json:"historyLimit"`
+	Plain         bool     `json:"plain"`
+	RequireE2E    bool     `json:"requireE2E"`
+	Headless      bool     `json:"headless"`
+	Clipboard     string   `json:"clipboard"`    // Backend, see clipboardBackends
+	ClipboardDir  string   `json:"clipboardDir"` // Used by the file backend, empty for the config folder
+	SendQueue     int      `json:"sendQueue"`    // Messages queued per device before the slow client policy applies
+	WriteTimeout  Duration `json:"writeTimeout"`
+	SlowClients   string   `json:"slowClients"`   // See slowClientPolicies
+	TransferGrace Duration `json:"transferGrace"` // How long interrupted transfers are kept for resuming, 0 to disable
+	PingInterval  Duration `json:"pingInterval"`
+	PongTimeout   Duration `json:"pongTimeout"` // How long past a ping a device may stay silent before it is disconnected
+
+	// Clips kept for paired devices that are not connected, see offlineDeliveryModes
+	OfflineDelivery string   `json:"offlineDelivery"`
+	OutboxLimit     int      `json:"outboxLimit"` // Clips per device
+	OutboxMaxAge    Duration `json:"outboxMaxAge"`
+	OutboxMaxBytes  int64    `json:"outboxMaxBytes"` // Per device
+
+	InitialSync string `json:"initialSync"` // See initialSyncModes
+}
+
+// Duration is a time.Duration written as "1s" or "500ms" in the config file
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"1s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	saveDir := filepath.Join("Desktop", "clipy")
+	if home, err := os.UserHomeDir(); err == nil {
+		saveDir = filepath.Join(home, saveDir)
+	}
+
+	return Config{
+		Port:          8080,
+		QRPort:        3000,
+		SaveDir:       saveDir,
+		Notifications: true,
+		PollInterval:  Duration(time.Second),
+		MaxPayload:    32 << 20,
+		HistoryLimit:  500,
+		Clipboard:     backendAuto,
+		SendQueue:     16,
+		WriteTimeout:  Duration(10 * time.Second),
+		SlowClients:   slowClientDrop,
+		TransferGrace: Duration(2 * time.Minute),
+		PingInterval:  Duration(15 * time.Second),
+		PongTimeout:   Duration(10 * time.Second),
+
+		OfflineDelivery: offlineLatest,
+		OutboxLimit:     10,
+		OutboxMaxAge:    Duration(time.Hour),
+		OutboxMaxBytes:  64 << 20,
+
+		InitialSync: syncPushLatest,
+	}
+}
+
+// A setting that can be given as a flag or an environment variable. The
+// environment variable is the flag name in upper case with a CLIPY_ prefix.
+type configOption struct {
+	name   string
+	usage  string
+	isBool bool
+	set    func(c *Config, value string) error
+	get    func(c *Config) string
+}
+
+var configOptions = []configOption{
+	intOption("port", "port of the WebSocket server", func(c *Config) *int { return &c.Port }),
+	intOption("qr-port", "port of the local QR code and history pages", func(c *Config) *int { return &c.QRPort }),
+	stringOption("bind-address", "address to listen on, empty for the detected Wi-Fi address", func(c *Config) *string { return &c.BindAddress }),
+	stringOption("save-dir", "folder received images are saved to", func(c *Config) *string { return &c.SaveDir }),
+	boolOption("notifications", "show desktop notifications", func(c *Config) *bool { return &c.Notifications }),
+	durationOption("poll-interval", "how often the clipboard is checked when the backend cannot report changes", func(c *Config) *Duration { return &c.PollInterval }),
+	int64Option("max-payload", "largest message accepted from a device, in bytes", func(c *Config) *int64 { return &c.MaxPayload }),
+	intOption("history-limit", "number of clipboard items kept in the history", func(c *Config) *int { return &c.HistoryLimit }),
+	boolOption("plain", "serve unencrypted ws:// instead of wss:// (not recommended)", func(c *Config) *bool { return &c.Plain }),
+	boolOption("require-e2e", "refuse devices that do not support end-to-end encryption", func(c *Config) *bool { return &c.RequireE2E }),
+	boolOption("headless", "run without the system tray and desktop notifications", func(c *Config) *bool { return &c.Headless }),
+	stringOption("clipboard", "clipboard backend: "+strings.Join(clipboardBackends, ", "), func(c *Config) *string { return &c.Clipboard }),
+	stringOption("clipboard-dir", "folder used by the file clipboard backend", func(c *Config) *string { return &c.ClipboardDir }),
+	intOption("send-queue", "messages queued per device before the slow client policy applies", func(c *Config) *int { return &c.SendQueue }),
+	durationOption("write-timeout", "how long a single write to a device may take before it is disconnected", func(c *Config) *Duration { return &c.WriteTimeout }),
+	stringOption("slow-clients", "what to do when a device's queue is full: "+strings.Join(slowClientPolicies, ", "), func(c *Config) *string { return &c.SlowClients }),
+	durationOption("transfer-grace", "how long an interrupted transfer is kept for the device to resume it, 0 to disable", func(c *Config) *Duration { return &c.TransferGrace }),
+	durationOption("ping-interval", "how often devices are pinged to check they are still there", func(c *Config) *Duration { return &c.PingInterval }),
+	durationOption("pong-timeout", "how long past a ping a silent device is disconnected", func(c *Config) *Duration { return &c.PongTimeout }),
+	stringOption("offline-delivery", "clips a device gets after being away: "+strings.Join(offlineDeliveryModes, ", "), func(c *Config) *string { return &c.OfflineDelivery }),
+	intOption("outbox-limit", "clips kept per device while it is away", func(c *Config) *int { return &c.OutboxLimit }),
+	durationOption("outbox-max-age", "how long clips are kept for a device that is away", func(c *Config) *Duration { return &c.OutboxMaxAge }),
+	int64Option("outbox-max-bytes", "bytes of clips kept per device while it is away", func(c *Config) *int64 { return &c.OutboxMaxBytes }),
+	stringOption("initial-sync", "what happens when a device connects: "+strings.Join(initialSyncModes, ", "), func(c *Config) *string { return &c.InitialSync }),
+}
+
+func intOption(name, usage string, field func(*Config) *int) configOption {
+	return configOption{name: name, usage: usage,
+		set: func(c *Config, v string) (err error) { *field(c), err = strconv.Atoi(v); return },
+		get: func(c *Config) string { return strconv.Itoa(*field(c)) },
+	}
+}
+
+func int64Option(name, usage string, field func(*Config) *int64) configOption {
+	return configOption{name: name, usage: usage,
+		set: func(c *Config, v string) (err error) { *field(c), err = strconv.ParseInt(v, 10, 64); return },
+		get: func(c *Config) string { return strconv.FormatInt(*field(c), 10) },
+	}
+}
+
+func boolOption(name, usage string, field func(*Config) *bool) configOption {
+	return configOption{name: name, usage: usage, isBool: true,
+		set: func(c *Config, v string) (err error) { *field(c), err = strconv.ParseBool(v); return },
+		get: func(c *Config) string { return strconv.FormatBool(*field(c)) },
+	}
+}
+
+func stringOption(name, usage string, field func(*Config) *string) configOption {
+	return configOption{name: name, usage: usage,
+		set: func(c *Config, v string) error { *field(c) = v; return nil },
+		get: func(c *Config) string { return strconv.Quote(*field(c)) },
+	}
+}
+
+func durationOption(name, usage string, field func(*Config) *Duration) configOption {
+	return configOption{name: name, usage: usage,
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			*field(c) = Duration(d)
+			return err
+		},
+		get: func(c *Config) string { return time.Duration(*field(c)).String() },
+	}
+}
+
+// Records a flag's raw value so it can be applied after the file and the
+// environment, whatever order they are read in
+type optionFlag struct {
+	opt   *configOption
+	value string
+	given bool
+}
+
+func (f *optionFlag) String() string     { return f.value }
+func (f *optionFlag) IsBoolFlag() bool   { return f.opt != nil && f.opt.isBool }
+func (f *optionFlag) Set(v string) error { f.value, f.given = v, true; return nil }
+
+// Build the configuration from the config file, environment and flags
+func loadConfig(args []string) (Config, error) {
+	fs := flag.NewFlagSet(appName, flag.ContinueOnError)
+	configPath := fs.String("config", "", "path of the config file (default: config.json in the Clipy config directory)")
+
+	var flags []*optionFlag
+	defaults := defaultConfig()
+	for i := range configOptions {
+		opt := &configOptions[i]
+		f := &optionFlag{opt: opt}
+		flags = append(flags, f)
+		fs.Var(f, opt.name, fmt.Sprintf("%s (env %s, default %s)", opt.usage, envName(opt.name), opt.get(&defaults)))
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	cfg := defaults
+
+	path := *configPath
+	if path == "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+	explicit := path != ""
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err == nil {
+			path = filepath.Join(dir, "clipy", configFile)
+		}
+	}
+	if path != "" {
+		if err := readConfigFile(path, &cfg, explicit); err != nil {
+			return Config{}, err
+		}
+	}
+
+	for i := range configOptions {
+		opt := &configOptions[i]
+		if v, ok := os.LookupEnv(envName(opt.name)); ok {
+			if err := opt.set(&cfg, v); err != nil {
+				return Config{}, fmt.Errorf("invalid value %q for %s: %v", v, envName(opt.name), parseError(err))
+			}
+		}
+	}
+
+	for _, f := range flags {
+		if f.given {
+			if err := f.opt.set(&cfg, f.value); err != nil {
+				return Config{}, fmt.Errorf("invalid value %q for -%s: %v", f.value, f.opt.name, parseError(err))
+			}
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// Read the JSON config file over cfg. A missing file is only an error if the
+// user asked for it explicitly.
+func readConfigFile(path string, cfg *Config, explicit bool) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	fmt.Println("[INFO] Loaded config from", path)
+	return nil
+}
+
+// Check that the settings make sense together
+func (c *Config) validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.QRPort < 1 || c.QRPort > 65535 {
+		return fmt.Errorf("qrPort must be between 1 and 65535, got %d", c.QRPort)
+	}
+	if c.Port == c.QRPort {
+		return fmt.Errorf("port and qrPort must differ, both are %d", c.Port)
+	}
+	if c.BindAddress != "" && net.ParseIP(c.BindAddress) == nil {
+		return fmt.Errorf("bindAddress must be an IP address, got %q", c.BindAddress)
+	}
+	if c.SaveDir == "" {
+		return fmt.Errorf("saveDir must not be empty")
+	}
+	if d := time.Duration(c.PollInterval); d < 100*time.Millisecond || d > time.Minute {
+		return fmt.Errorf("pollInterval must be between 100ms and 1m, got %s", d)
+	}
+	if c.MaxPayload < 1<<10 || c.MaxPayload > 1<<30 {
+		return fmt.Errorf("maxPayload must be between 1 KiB and 1 GiB, got %d bytes", c.MaxPayload)
+	}
+	if c.HistoryLimit < 1 {
+		return fmt.Errorf("historyLimit must be at least 1, got %d", c.HistoryLimit)
+	}
+	if !slices.Contains(clipboardBackends, c.Clipboard) {
+		return fmt.Errorf("clipboard must be one of %s, got %q", strings.Join(clipboardBackends, ", "), c.Clipboard)
+	}
+	if c.SendQueue < 1 || c.SendQueue > 1024 {
+		return fmt.Errorf("sendQueue must be between 1 and 1024, got %d", c.SendQueue)
+	}
+	if d := time.Duration(c.WriteTimeout); d < time.Second || d > 5*time.Minute {
+		return fmt.Errorf("writeTimeout must be between 1s and 5m, got %s", d)
+	}
+	if !slices.Contains(slowClientPolicies, c.SlowClients) {
+		return fmt.Errorf("slowClients must be one of %s, got %q", strings.Join(slowClientPolicies, ", "), c.SlowClients)
+	}
+	if d := time.Duration(c.TransferGrace); d < 0 || d > time.Hour {
+		return fmt.Errorf("transferGrace must be between 0 and 1h, got %s", d)
+	}
+	if d := time.Duration(c.PingInterval); d < time.Second || d > 5*time.Minute {
+		return fmt.Errorf("pingInterval must be between 1s and 5m, got %s", d)
+	}
+	if d := time.Duration(c.PongTimeout); d < time.Second || d > 5*time.Minute {
+		return fmt.Errorf("pongTimeout must be between 1s and 5m, got %s", d)
+	}
+	if !slices.Contains(offlineDeliveryModes, c.OfflineDelivery) {
+		return fmt.Errorf("offlineDelivery must be one of %s, got %q", strings.Join(offlineDeliveryModes, ", "), c.OfflineDelivery)
+	}
+	if c.OutboxLimit < 1 || c.OutboxLimit > 100 {
+		return fmt.Errorf("outboxLimit must be between 1 and 100, got %d", c.OutboxLimit)
+	}
+	if d := time.Duration(c.OutboxMaxAge); d < time.Minute || d > 7*24*time.Hour {
+		return fmt.Errorf("outboxMaxAge must be between 1m and 168h, got %s", d)
+	}
+	if c.OutboxMaxBytes < 0 || c.OutboxMaxBytes > 1<<30 {
+		return fmt.Errorf("outboxMaxBytes must be between 0 and 1 GiB, got %d", c.OutboxMaxBytes)
+	}
+	if !slices.Contains(initialSyncModes, c.InitialSync) {
+		return fmt.Errorf("initialSync must be one of %s, got %q", strings.Join(initialSyncModes, ", "), c.InitialSync)
+	}
+	return nil
+}
+
+// Strip the strconv function name from parse errors, the caller already
+// says which setting was wrong
+func parseError(err error) error {
+	if ne, ok := err.(*strconv.NumError); ok {
+		return ne.Err
+	}
+	return err
+}
+
+func envName(option string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(option, "-", "_"))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Point the config directory at a temporary one and return the path of the
+// default config file in it
+func isolateConfig(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("AppData", dir)
+	// Setenv restores what the environment held once the test is done
+	for _, opt := range configOptions {
+		if _, ok := os.LookupEnv(envName(opt.name)); ok {
+			t.Setenv(envName(opt.name), "")
+			os.Unsetenv(envName(opt.name))
+		}
+	}
+	t.Setenv(envPrefix+"CONFIG", "")
+	os.Unsetenv(envPrefix + "CONFIG")
+
+	path, err := os.UserConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(path, "clipy", configFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := isolateConfig(t)
+	if err := os.WriteFile(path, []byte(`{"port": 9000, "qrPort": 9001, "pollInterval": "2s", "notifications": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CLIPY_PORT", "9100")
+	t.Setenv("CLIPY_NOTIFICATIONS", "false")
+
+	cfg, err := loadConfig([]string{"-port", "9200", "-plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 9200 {
+		t.Errorf("port %d, the flag should win", cfg.Port)
+	}
+	if cfg.QRPort != 9001 || time.Duration(cfg.PollInterval) != 2*time.Second {
+		t.Errorf("qrPort %d, pollInterval %s, the file should apply", cfg.QRPort, time.Duration(cfg.PollInterval))
+	}
+	if cfg.Notifications {
+		t.Error("notifications on, the environment should override the file")
+	}
+	if !cfg.Plain {
+		t.Error("-plain was ignored")
+	}
+	if cfg.HistoryLimit != defaultConfig().HistoryLimit {
+		t.Errorf("historyLimit %d, the default should apply", cfg.HistoryLimit)
+	}
+}
+
+func TestConfigFileLocation(t *testing.T) {
+	isolateConfig(t)
+
+	// Without a file the defaults apply
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != defaultConfig().Port {
+		t.Fatalf("port %d without a config file", cfg.Port)
+	}
+
+	// A file the user named has to exist
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	if _, err := loadConfig([]string{"-config", missing}); err == nil {
+		t.Fatal("missing -config file accepted")
+	}
+	t.Setenv("CLIPY_CONFIG", missing)
+	if _, err := loadConfig(nil); err == nil {
+		t.Fatal("missing CLIPY_CONFIG file accepted")
+	}
+
+	other := filepath.Join(t.TempDir(), "other.json")
+	if err := os.WriteFile(other, []byte(`{"port": 9300}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = loadConfig([]string{"-config", other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 9300 {
+		t.Fatalf("port %d, want the one from -config", cfg.Port)
+	}
+}
+
+func TestConfigRejectsBadValues(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  [2]string
+		args []string
+		want string
+	}{
+		{name: "unknown field", file: `{"prot": 1}`, want: "unknown field"},
+		{name: "bad duration", file: `{"pollInterval": 5}`, want: "duration must be a string"},
+		{name: "port range", file: `{"port": 0}`, want: "port must be between"},
+		{name: "same ports", args: []string{"-port", "4000", "-qr-port", "4000"}, want: "must differ"},
+		{name: "bind address", args: []string{"-bind-address", "wifi"}, want: "bindAddress must be an IP address"},
+		{name: "backend", args: []string{"-clipboard", "magic"}, want: "clipboard must be one of"},
+		{name: "poll interval", args: []string{"-poll-interval", "1ms"}, want: "pollInterval must be between"},
+		{name: "env number", env: [2]string{"CLIPY_PORT", "abc"}, want: `invalid value "abc" for CLIPY_PORT: invalid syntax`},
+		{name: "flag number", args: []string{"-max-payload", "lots"}, want: `invalid value "lots" for -max-payload`},
+		{name: "max payload", args: []string{"-max-payload", "10"}, want: "maxPayload must be between"},
+		{name: "offline mode", args: []string{"-offline-delivery", "sometimes"}, want: "offlineDelivery must be one of"},
+		{name: "extra argument", args: []string{"8080"}, want: "unexpected argument"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := isolateConfig(t)
+			if tt.file != "" {
+				if err := os.WriteFile(path, []byte(tt.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.env[0] != "" {
+				t.Setenv(tt.env[0], tt.env[1])
+			}
+			_, err := loadConfig(tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What became of a clip on a device, reported in a receipt
+const (
+	receiptApplied    = "applied"    // Written to the clipboard
+	receiptFailed     = "failed"     // Could not be written, the reason says why
+	receiptSuperseded = "superseded" // The device already holds a newer clip
+)
+
+// Outcomes of devices that sent no receipt
+const (
+	deliverySent    = "sent"    // The device does not send receipts
+	deliveryTimeout = "timeout" // No receipt arrived in time
+	deliveryQueued  = "queued"  // The device is away, it gets the clip when it comes back
+)
+
+// How long to wait for receipts before reporting a clip's delivery
+const receiptTimeout = 30 * time.Second
+
+// Receipt is the payload of a receipt message. Devices send one for every
+// clip they receive. The server sends its own to the clip's sender and
+// forwards the receipts of other devices to it, with Device and Name set.
+type Receipt struct {
+	Clip   string `json:"clip"` // ID of the clip
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+	Device string `json:"device,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+// A device a clip was queued for
+type recipient struct {
+	deviceID string
+	echoKey  string // See client.echoKey
+	name     string
+	receipts bool // Whether it reports what became of the clip
+	queued   bool // Kept in its outbox until it reconnects
+}
+
+// Clips waiting for receipts, by clip ID
+type deliveryTracker struct {
+	mu      sync.Mutex
+	pending map[string]*delivery
+}
+
+type delivery struct {
+	clip     string
+	source   *client           // Sender to forward receipts to, nil for local copies and clients without receipts
+	local    bool              // Copied on this PC
+	receipts bool              // Some recipient sends receipts
+	waiting  map[string]string // Device ID to name, of recipients yet to report
+	results  []deliveryResult
+	timer    *time.Timer
+}
+
+type deliveryResult struct {
+	name   string
+	status string
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{pending: make(map[string]*delivery)}
+}
+
+// Start waiting for the receipts of a clip queued for the given devices.
+// source is the device it came from, nil for a clip copied on this PC.
+func (t *deliveryTracker) track(msg *Message, source *client, recipients []recipient) {
+	if len(recipients) == 0 {
+		return
+	}
+	d := &delivery{clip: msg.ID, local: source == nil, waiting: make(map[string]string)}
+	if source != nil && source.version >= receiptVersion {
+		d.source = source
+	}
+	for _, r := range recipients {
+		switch {
+		case r.queued:
+			d.results = append(d.results, deliveryResult{name: r.name, status: deliveryQueued})
+		case r.receipts:
+			d.waiting[r.deviceID] = r.name
+			d.receipts = true
+		default:
+			d.results = append(d.results, deliveryResult{name: r.name, status: deliverySent})
+		}
+	}
+	if len(d.waiting) == 0 {
+		d.finish()
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d.timer = time.AfterFunc(receiptTimeout, func() { t.expire(d) })
+	t.pending[d.clip] = d
+}
+
+// Record a receipt from a device, forwarding it to the clip's sender
+func (t *deliveryTracker) report(c *client, msg *Message) {
+	var r Receipt
+	if err := json.Unmarshal(msg.Payload, &r); err != nil || r.Clip == "" || !validReceiptStatus(r.Status) {
+		fmt.Printf("[ERROR] Invalid receipt from %s\n", c.displayName())
+		return
+	}
+	if r.Status == receiptFailed {
+		fmt.Printf("[WARN] %s failed to apply clip %s: %s\n", c.displayName(), r.Clip, r.Reason)
+	}
+
+	t.mu.Lock()
+	d := t.pending[r.Clip]
+	if d == nil {
+		t.mu.Unlock()
+		return
+	}
+	name, ok := d.waiting[c.deviceID]
+	if !ok {
+		t.mu.Unlock()
+		return
+	}
+	delete(d.waiting, c.deviceID)
+	d.results = append(d.results, deliveryResult{name: name, status: r.Status})
+	done := len(d.waiting) == 0
+	if done {
+		d.timer.Stop()
+		delete(t.pending, d.clip)
+	}
+	t.mu.Unlock()
+
+	if d.source != nil {
+		r.Device, r.Name = c.deviceID, name
+		if err := sendMessage(d.source, newControlMessage(msgTypeReceipt, r)); err != nil {
+			fmt.Printf("[ERROR] Failed to forward receipt to %s: %v\n", d.source.displayName(), err)
+		}
+	}
+	if done {
+		d.finish()
+	}
+}
+
+// Give up on the receipts still missing for a clip
+func (t *deliveryTracker) expire(d *delivery) {
+	t.mu.Lock()
+	if t.pending[d.clip] != d {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.pending, d.clip)
+	names := make([]string, 0, len(d.waiting))
+	for _, name := range d.waiting {
+		names = append(names, name)
+	}
+	t.mu.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		d.results = append(d.results, deliveryResult{name: name, status: deliveryTimeout})
+	}
+	d.finish()
+}
+
+// Forget every clip, when the server stops
+func (t *deliveryTracker) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, d := range t.pending {
+		d.timer.Stop()
+		delete(t.pending, id)
+	}
+}
+
+// Report where a clip arrived. Clips copied on this PC are shown in the tray
+// and, when a device confirms or fails to, in a notification.
+func (d *delivery) finish() {
+	summary := d.summary()
+	fmt.Printf("[INFO] Clip %s: %s\n", d.clip, summary)
+	if !d.local {
+		return
+	}
+	updateDeliveryStatus(summary)
+	if !d.receipts {
+		return
+	}
+	if d.delivered() {
+		sendNotification("Clip Delivered", summary)
+	} else {
+		sendNotification("Delivery Failed", summary)
+	}
+}
+
+// Whether every device that sends receipts applied the clip. Devices that are
+// away do not count as failures, they get the clip when they come back.
+func (d *delivery) delivered() bool {
+	for _, r := range d.results {
+		if r.status != receiptApplied && r.status != deliverySent && r.status != deliveryQueued {
+			return false
+		}
+	}
+	return true
+}
+
+// Describe the outcome per device, such as "Delivered to Pixel 8, failed on
+// Tablet"
+func (d *delivery) summary() string {
+	phrases := []struct {
+		status string
+		text   string
+	}{
+		{receiptApplied, "delivered to"},
+		{receiptFailed, "failed on"},
+		{receiptSuperseded, "newer clip on"},
+		{deliveryTimeout, "no answer from"},
+		{deliverySent, "sent to"},
+		{deliveryQueued, "queued for"},
+	}
+	var parts []string
+	for _, p := range phrases {
+		var names []string
+		for _, r := range d.results {
+			if r.status == p.status {
+				names = append(names, r.name)
+			}
+		}
+		if len(names) > 0 {
+			parts = append(parts, p.text+" "+strings.Join(names, ", "))
+		}
+	}
+	summary := strings.Join(parts, ", ")
+	if summary == "" {
+		return ""
+	}
+	return strings.ToUpper(summary[:1]) + summary[1:]
+}
+
+func validReceiptStatus(status string) bool {
+	return status == receiptApplied || status == receiptFailed || status == receiptSuperseded
+}
+
+// Tell a client what became of a clip it sent, if it takes receipts
+func (c *client) sendReceipt(clip, status string, err error) {
+	if c.version < receiptVersion {
+		return
+	}
+	r := Receipt{Clip: clip, Status: status, Device: localDeviceID, Name: "This PC"}
+	if err != nil {
+		r.Reason = err.Error()
+	}
+	if err := sendMessage(c, newControlMessage(msgTypeReceipt, r)); err != nil {
+		fmt.Printf("[ERROR] Failed to send receipt to %s: %v\n", c.displayName(), err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Close reasons for connections ended from the PC
+const (
+	disconnectReason = "disconnected from the PC"
+	forgetReason     = "device was unpaired"
+)
+
+// Which way clips may go between the PC and a device
+const (
+	directionBoth       = "both"
+	directionToDevice   = "to-device"   // The device only receives clips
+	directionFromDevice = "from-device" // The device only sends clips
+)
+
+var syncDirections = []string{directionBoth, directionToDevice, directionFromDevice}
+
+// Settings the user picks per device. The zero value syncs everything both
+// ways, so devices paired before settings existed keep working.
+type deviceSettings struct {
+	Disabled     bool     `json:"disabled,omitempty"`     // Stays connected but exchanges no clips
+	Direction    string   `json:"direction,omitempty"`    // See syncDirections, empty means both
+	ContentTypes []string `json:"contentTypes,omitempty"` // Empty allows every type
+}
+
+// Whether the device may get clips of the given type from the PC
+func (s deviceSettings) receives(mime string) bool {
+	return !s.Disabled && s.Direction != directionFromDevice && s.allows(mime)
+}
+
+// Whether clips of the given type are taken from the device
+func (s deviceSettings) sends(mime string) bool {
+	return !s.Disabled && s.Direction != directionToDevice && s.allows(mime)
+}
+
+func (s deviceSettings) allows(mime string) bool {
+	return len(s.ContentTypes) == 0 || slices.Contains(s.ContentTypes, mime)
+}
+
+func (s deviceSettings) validate() error {
+	if s.Direction != "" && !slices.Contains(syncDirections, s.Direction) {
+		return fmt.Errorf("direction must be one of %s, got %q", strings.Join(syncDirections, ", "), s.Direction)
+	}
+	for _, t := range s.ContentTypes {
+		if !slices.Contains(supportedContentTypes, t) {
+			return fmt.Errorf("content type must be one of %s, got %q", strings.Join(supportedContentTypes, ", "), t)
+		}
+	}
+	return nil
+}
+
+// Totals over every connection of a device, from the PC's side
+type deviceStats struct {
+	BytesSent     int64 `json:"bytesSent"`
+	BytesReceived int64 `json:"bytesReceived"`
+	ClipsSent     int64 `json:"clipsSent"`
+	ClipsReceived int64 `json:"clipsReceived"`
+}
+
+// Traffic of one connection, added to the device's stats when it ends
+type connTraffic struct {
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+	clipsSent     atomic.Int64
+	clipsReceived atomic.Int64
+}
+
+// Settings of a paired device, the defaults for anything else
+func deviceSettingsFor(id string) deviceSettings {
+	pairingMutex.Lock()
+	defer pairingMutex.Unlock()
+
+	for _, d := range pairing.Devices {
+		if d.ID == id {
+			return d.Settings
+		}
+	}
+	return deviceSettings{}
+}
+
+// Record that a paired device connected. Returns the name it is registered
+// under, which the user may have changed from the one the device reported.
+func markDeviceSeen(id, platform string) string {
+	pairingMutex.Lock()
+	defer pairingMutex.Unlock()
+
+	for _, d := range pairing.Devices {
+		if d.ID != id {
+			continue
+		}
+		d.LastSeen = time.Now()
+		if platform != "" {
+			d.Platform = platform
+		}
+		if err := savePairedDevices(); err != nil {
+			fmt.Println("[ERROR] Failed to save device registry:", err)
+		}
+		return d.Name
+	}
+	return ""
+}
+
+// Add the traffic of a connection that ended to its device's stats
+func recordDeviceVisit(c *client) {
+	if c.deviceID == "" {
+		return
+	}
+	pairingMutex.Lock()
+	defer pairingMutex.Unlock()
+
+	for _, d := range pairing.Devices {
+		if d.ID != c.deviceID {
+			continue
+		}
+		d.LastSeen = time.Now()
+		d.Stats.BytesSent += c.traffic.bytesSent.Load()
+		d.Stats.BytesReceived += c.traffic.bytesReceived.Load()
+		d.Stats.ClipsSent += c.traffic.clipsSent.Load()
+		d.Stats.ClipsReceived += c.traffic.clipsReceived.Load()
+		if err := savePairedDevices(); err != nil {
+			fmt.Println("[ERROR] Failed to save device registry:", err)
+		}
+		return
+	}
+}
+
+// Rename a device or change its settings. Connected devices pick up new
+// settings with the next clip and a new name when they reconnect.
+func updateDevice(id string, name *string, settings *deviceSettings) error {
+	if settings != nil {
+		if err := settings.validate(); err != nil {
+			return err
+		}
+	}
+
+	pairingMutex.Lock()
+	defer pairingMutex.Unlock()
+
+	for _, d := range pairing.Devices {
+		if d.ID != id {
+			continue
+		}
+		old := *d
+		if name != nil {
+			d.Name = strings.TrimSpace(*name)
+		}
+		if settings != nil {
+			d.Settings = *settings
+		}
+		if err := savePairedDevices(); err != nil {
+			*d = old
+			return err
+		}
+		fmt.Printf("[INFO] Updated device %s (%s)\n", d.displayName(), d.ID)
+		return nil
+	}
+	return fmt.Errorf("unknown device %s", id)
+}
+
+// Pause or resume sync with a single device. It stays connected either way.
+func pauseDevice(id string, paused bool) error {
+	settings := deviceSettingsFor(id)
+	settings.Disabled = paused
+	return updateDevice(id, nil, &settings)
+}
+
+// Close a client's connection from the PC. Paired devices may connect again.
+func disconnectClient(c *client) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	if clients[c.conn] != c {
+		return // Already gone
+	}
+	fmt.Printf("[INFO] Disconnecting %s\n", c.displayName())
+	c.enqueueClose(websocket.CloseNormalClosure, disconnectReason)
+	c.shutdown()
+}
+
+// Unpair a device, so it has to scan the QR code again to connect. Clips
+// kept for it are dropped and its connections are closed.
+func (s *Server) forgetDevice(id string) error {
+	pairingMutex.Lock()
+	i := slices.IndexFunc(pairing.Devices, func(d *pairedDevice) bool { return d.ID == id })
+	if i < 0 {
+		pairingMutex.Unlock()
+		return fmt.Errorf("unknown device %s", id)
+	}
+	name := pairing.Devices[i].displayName()
+	saved := pairing.Devices
+	pairing.Devices = slices.Delete(slices.Clone(saved), i, i+1)
+	if err := savePairedDevices(); err != nil {
+		pairing.Devices = saved
+		pairingMutex.Unlock()
+		return err
+	}
+	pairingMutex.Unlock()
+
+	s.outbox.take(id)
+	clientsMutex.Lock()
+	for _, c := range clients {
+		if c.deviceID == id {
+			c.enqueueClose(websocket.ClosePolicyViolation, forgetReason)
+			c.shutdown()
+		}
+	}
+	clientsMutex.Unlock()
+	fmt.Printf("[INFO] Forgot device %s (%s)\n", name, id)
+	return nil
+}
+
+// A device as listed on the local page server, without its credentials
+type deviceInfo struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`
+	Platform  string         `json:"platform"`
+	FirstSeen time.Time      `json:"firstSeen"`
+	LastSeen  time.Time      `json:"lastSeen,omitempty"`
+	Connected bool           `json:"connected"`
+	Encrypted bool           `json:"encrypted"`
+	Stats     deviceStats    `json:"stats"`
+	Settings  deviceSettings `json:"settings"`
+}
+
+// Serve the device registry as JSON on the local-only page server. POST
+// ?id= with {"name": ..., "settings": {...}} renames a device or changes its
+// settings; either field may be left out. Only JSON bodies are accepted, so
+// a web page cannot make the browser send one without a CORS preflight.
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+			http.Error(w, "expected a JSON body", http.StatusUnsupportedMediaType)
+			return
+		}
+		var update struct {
+			Name     *string         `json:"name"`
+			Settings *deviceSettings `json:"settings"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&update); err != nil {
+			http.Error(w, "invalid update: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := updateDevice(r.URL.Query().Get("id"), update.Name, update.Settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updateConnectedDevices() // A paused device shows as such in the tray
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	connected := make(map[string]bool)
+	clientsMutex.Lock()
+	for _, c := range clients {
+		connected[c.deviceID] = true
+	}
+	clientsMutex.Unlock()
+
+	devices := listPairedDevices()
+	infos := make([]deviceInfo, len(devices))
+	for i, d := range devices {
+		infos[i] = deviceInfo{
+			ID:        d.ID,
+			Name:      d.displayName(),
+			Platform:  d.Platform,
+			FirstSeen: d.PairedAt,
+			LastSeen:  d.LastSeen,
+			Connected: connected[d.ID],
+			Encrypted: d.EncKey != nil,
+			Stats:     d.Stats,
+			Settings:  d.Settings,
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].LastSeen.After(infos[j].LastSeen) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Cipher suite named in the enc field of encrypted messages
+const encAESGCM = "aes-256-gcm"
+
+// HKDF info strings, versioned so the derivation can change later
+const (
+	pairingKeyInfo  = "clipy pairing v2"
+	clientToServer  = "clipy session v1 c2s"
+	serverToClient  = "clipy session v1 s2c"
+	sessionNonceLen = 16
+)
+
+// Per-connection encryption state. Each direction has its own key so the
+// sequence numbers of both sides never share a key.
+type session struct {
+	sendAEAD cipher.AEAD
+	recvAEAD cipher.AEAD
+	sendSeq  uint64 // Last sequence number sent, guarded by clientsMutex
+	recvSeq  uint64 // Highest sequence number accepted, only used by the reader
+}
+
+// Complete the X25519 exchange of a pairing and derive the long-lived key
+// shared with the device, authenticated by the pairing secret from the QR
+// code. Returns the key and the server's public key.
+func pairingKeyExchange(clientPublicKey, secret string) ([]byte, string, error) {
+	if secret == "" {
+		return nil, "", fmt.Errorf("no pairing secret to authenticate the key exchange, scan the QR code again")
+	}
+	raw, err := base64.StdEncoding.DecodeString(clientPublicKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid public key encoding: %v", err)
+	}
+	peer, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid public key: %v", err)
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate key: %v", err)
+	}
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, "", fmt.Errorf("key exchange failed: %v", err)
+	}
+
+	pub := priv.PublicKey().Bytes()
+	return derivePairingKey(shared, secret, raw, pub), base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// Device key derived from the X25519 shared secret, the same on both sides.
+// The pairing secret only travels in the QR code and salts the key, and both
+// public keys are bound into it, so whoever relays the pairing and swaps in
+// their own keys ends up with a different key than either side.
+func derivePairingKey(shared []byte, secret string, clientPublicKey, serverPublicKey []byte) []byte {
+	info := append([]byte(pairingKeyInfo), clientPublicKey...)
+	info = append(info, serverPublicKey...)
+	return hkdfSHA256(shared, []byte(secret), info, 32)
+}
+
+// Derive the keys for one connection from the device key and the nonces
+// both sides contributed, so every session uses fresh keys
+func newSession(deviceKey []byte, clientNonce, serverNonce string) (*session, error) {
+	cn, err := base64.StdEncoding.DecodeString(clientNonce)
+	if err != nil || len(cn) < sessionNonceLen {
+		return nil, fmt.Errorf("invalid session nonce")
+	}
+	sn, err := base64.StdEncoding.DecodeString(serverNonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session nonce")
+	}
+	salt := append(cn, sn...)
+
+	send, err := newAEAD(hkdfSHA256(deviceKey, salt, []byte(serverToClient), 32))
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newAEAD(hkdfSHA256(deviceKey, salt, []byte(clientToServer), 32))
+	if err != nil {
+		return nil, err
+	}
+	return &session{sendAEAD: send, recvAEAD: recv}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Random nonce sent in the hello or welcome to salt the session keys
+func newSessionNonce() string {
+	b := make([]byte, sessionNonceLen)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Encrypt the payload of a message. The envelope stays readable but is
+// authenticated as associated data, so it cannot be altered either.
+// The caller must hold clientsMutex.
+func (s *session) seal(msg *Message) (*Message, error) {
+	nonce := make([]byte, s.sendAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	s.sendSeq++
+	sealed := *msg
+	sealed.Enc = encAESGCM
+	sealed.Seq = s.sendSeq
+	sealed.Nonce = base64.StdEncoding.EncodeToString(nonce)
+
+	ciphertext := s.sendAEAD.Seal(nil, nonce, msg.Payload, associatedData(&sealed))
+	raw, err := json.Marshal(base64.StdEncoding.EncodeToString(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	sealed.Payload = raw
+	return &sealed, nil
+}
+
+// Encrypt a chunk of a transfer. The chunk header is authenticated, so a
+// chunk cannot be moved to another transfer or offset. The output is the
+// random nonce followed by the ciphertext. AES-GCM keeps no state between
+// calls, so writers may seal chunks without holding clientsMutex.
+func (s *session) sealChunk(header, chunk []byte) ([]byte, error) {
+	nonce := make([]byte, s.sendAEAD.NonceSize(), s.sendAEAD.NonceSize()+len(chunk)+s.sendAEAD.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return s.sendAEAD.Seal(nonce, nonce, chunk, header), nil
+}
+
+// Decrypt a chunk sealed by the client
+func (s *session) openChunk(header, sealed []byte) ([]byte, error) {
+	size := s.recvAEAD.NonceSize()
+	if len(sealed) < size {
+		return nil, fmt.Errorf("chunk too short")
+	}
+	chunk, err := s.recvAEAD.Open(nil, sealed[:size], sealed[size:], header)
+	if err != nil {
+		return nil, fmt.Errorf("chunk decryption failed: %v", err)
+	}
+	return chunk, nil
+}
+
+// Decrypt a message and reject anything already seen in this session
+func (s *session) open(msg *Message) (*Message, error) {
+	if msg.Enc != encAESGCM {
+		return nil, fmt.Errorf("unsupported encryption %q", msg.Enc)
+	}
+	if msg.Seq <= s.recvSeq {
+		return nil, fmt.Errorf("replayed or reordered message (seq %d, last %d)", msg.Seq, s.recvSeq)
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(msg.Nonce)
+	if err != nil || len(nonce) != s.recvAEAD.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	var encoded string
+	if err := json.Unmarshal(msg.Payload, &encoded); err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: %v", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: %v", err)
+	}
+
+	plaintext, err := s.recvAEAD.Open(nil, nonce, ciphertext, associatedData(msg))
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %v", err)
+	}
+	s.recvSeq = msg.Seq
+
+	opened := *msg
+	opened.Enc, opened.Nonce, opened.Seq = "", "", 0
+	opened.Payload = plaintext
+	return &opened, nil
+}
+
+// Envelope fields bound to the ciphertext. The clock is only appended when
+// present, so clients that do not stamp clips keep the original layout.
+func associatedData(msg *Message) []byte {
+	fields := []string{
+		strconv.Itoa(msg.Version),
+		msg.Type,
+		msg.ID,
+		msg.Origin,
+		strconv.FormatInt(msg.CreatedAt, 10),
+		msg.MIME,
+		msg.Enc,
+		strconv.FormatUint(msg.Seq, 10),
+	}
+	if msg.Clock != nil {
+		fields = append(fields, msg.Clock.String())
+	}
+	return []byte(strings.Join(fields, "|"))
+}
+
+// HKDF (RFC 5869) with SHA-256
+func hkdfSHA256(secret, salt, info []byte, length int) []byte {
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var out, block []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(info)
+		expand.Write([]byte{counter})
+		block = expand.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// Message types that carry clipboard content or describe it, and are
+// encrypted for clients with a session
+func sealedType(msgType string) bool {
+	return msgType == msgTypeClip || msgType == msgTypeOffer || msgType == msgTypeComplete || msgType == msgTypeReceipt
+}
+
+// Encode a message for one client, encrypting clips and transfers for
+// clients that negotiated end-to-end encryption. Devices paired with a key
+// never get them without a session. The caller must hold clientsMutex.
+func encodeFor(c *client, msg *Message) ([]byte, error) {
+	msg = msg.inline()
+	if sealedType(msg.Type) {
+		if c.session == nil {
+			if deviceEncrypted(c.deviceID) {
+				return nil, fmt.Errorf("%s uses end-to-end encryption but has no session", c.displayName())
+			}
+			return encodeMessage(msg, c.legacy)
+		}
+		sealed, err := c.session.seal(msg)
+		if err != nil {
+			return nil, err
+		}
+		msg = sealed
+	}
+	return encodeMessage(msg, c.legacy)
+}
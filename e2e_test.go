@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+// Both ends of a session: the server's and the client's, whose directions
+// are swapped
+func newTestSessions(t *testing.T) (*session, *session) {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	cn, sn := newSessionNonce(), newSessionNonce()
+	server, err := newSession(key, cn, sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newSession(key, cn, sn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.sendAEAD, client.recvAEAD = client.recvAEAD, client.sendAEAD
+	return server, client
+}
+
+func TestPairingKeyExchange(t *testing.T) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPub := priv.PublicKey().Bytes()
+	key, serverPub, err := pairingKeyExchange(base64.StdEncoding.EncodeToString(clientPub), "qr secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(serverPub)
+	peer, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(derivePairingKey(shared, "qr secret", clientPub, raw), key) {
+		t.Fatal("client and server derived different keys")
+	}
+
+	// Someone relaying the pairing knows neither the secret nor both keys
+	if bytes.Equal(derivePairingKey(shared, "guessed", clientPub, raw), key) {
+		t.Fatal("key does not depend on the pairing secret")
+	}
+	relayPriv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	if bytes.Equal(derivePairingKey(shared, "qr secret", relayPriv.PublicKey().Bytes(), raw), key) {
+		t.Fatal("key does not depend on the client's public key")
+	}
+
+	if _, _, err := pairingKeyExchange(base64.StdEncoding.EncodeToString(clientPub), ""); err == nil {
+		t.Fatal("key exchange without a pairing secret succeeded")
+	}
+	if _, _, err := pairingKeyExchange("not base64!", "qr secret"); err == nil {
+		t.Fatal("key exchange with an invalid public key succeeded")
+	}
+}
+
+func TestSessionSealAndOpen(t *testing.T) {
+	server, client := newTestSessions(t)
+
+	msg := newClipMessage(mimeText, []byte("secret"), localDeviceID).inline()
+	sealed, err := server.seal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed.Payload, []byte("secret")) {
+		t.Fatal("sealed payload holds the plaintext")
+	}
+	opened, err := client.open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := opened.clipData(); string(data) != "secret" {
+		t.Fatalf("opened %q", data)
+	}
+
+	// A replay, an older message and an altered envelope are all refused
+	if _, err := client.open(sealed); err == nil {
+		t.Fatal("replayed message accepted")
+	}
+	older, _ := server.seal(msg)
+	newer, _ := server.seal(msg)
+	if _, err := client.open(newer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.open(older); err == nil {
+		t.Fatal("reordered message accepted")
+	}
+	altered, _ := server.seal(msg)
+	altered.MIME = mimePNG
+	if _, err := client.open(altered); err == nil {
+		t.Fatal("altered envelope accepted")
+	}
+
+	// Each direction has its own key
+	if _, err := server.open(newer); err == nil {
+		t.Fatal("server opened its own message")
+	}
+}
+
+func TestSessionChunks(t *testing.T) {
+	server, client := newTestSessions(t)
+
+	header := chunkHeader("transfer", 64)
+	sealed, err := server.sealChunk(header, []byte("chunk data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, err := client.openChunk(header, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(chunk) != "chunk data" {
+		t.Fatalf("opened %q", chunk)
+	}
+
+	// A chunk cannot be moved to another offset or altered
+	if _, err := client.openChunk(chunkHeader("transfer", 0), sealed); err == nil {
+		t.Fatal("chunk opened at another offset")
+	}
+	sealed[len(sealed)-1] ^= 0xff
+	if _, err := client.openChunk(header, sealed); err == nil {
+		t.Fatal("altered chunk opened")
+	}
+	if _, err := client.openChunk(header, sealed[:4]); err == nil {
+		t.Fatal("truncated chunk opened")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How long and how many clips are remembered for loop suppression
+const (
+	echoCacheTTL   = 2 * time.Minute
+	echoCacheLimit = 256
+)
+
+// A clip the server recently applied or sent out
+type seenClip struct {
+	id     string
+	hash   string
+	origin string          // Device the clip came from, localDeviceID for the PC
+	at     time.Time       // When it was first seen
+	sentTo map[string]bool // Devices it was delivered to, by echo key
+}
+
+// Recent clips keyed by message ID and content hash. Stops a clip from
+// bouncing back to where it came from, and applies a clip that reaches the
+// server over two paths only once.
+type echoCache struct {
+	mu     sync.Mutex
+	byID   map[string]*seenClip
+	byHash map[string]*seenClip
+	order  []*seenClip // Oldest first
+	latest string      // Hash of the clip recorded last
+}
+
+func newEchoCache() *echoCache {
+	return &echoCache{
+		byID:   make(map[string]*seenClip),
+		byHash: make(map[string]*seenClip),
+	}
+}
+
+// Check a clip received from a device. Returns the earlier sighting and
+// false if the clip must not be applied, otherwise records it and returns
+// true. A clip is a repeat when its message ID was seen, when it comes back
+// from a device it was sent to and that has not copied anything since, or
+// when its content is still the latest. from is the sender's echo key.
+func (e *echoCache) accept(id, hash, from string) (*seenClip, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expire(time.Now())
+
+	if prev, ok := e.byID[id]; ok && id != "" {
+		return prev, false
+	}
+	if prev, ok := e.byHash[hash]; ok && (prev.sentTo[from] || hash == e.latest) {
+		return prev, false
+	}
+
+	// The device copied something else, so what it was sent before is no
+	// longer on its clipboard and copying it again is not an echo
+	for _, clip := range e.order {
+		delete(clip.sentTo, from)
+	}
+	e.add(id, hash, from)
+	return nil, true
+}
+
+// Record a clip that originated on the PC
+func (e *echoCache) record(id, hash string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expire(time.Now())
+	e.add(id, hash, localDeviceID)
+}
+
+// Remember which devices, by echo key, a clip was delivered to
+func (e *echoCache) delivered(hash string, devices []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if clip, ok := e.byHash[hash]; ok {
+		for _, id := range devices {
+			clip.sentTo[id] = true
+		}
+	}
+}
+
+// The caller must hold e.mu
+func (e *echoCache) add(id, hash, origin string) {
+	clip := &seenClip{id: id, hash: hash, origin: origin, at: time.Now(), sentTo: make(map[string]bool)}
+	if id != "" {
+		e.byID[id] = clip
+	}
+	e.byHash[hash] = clip
+	e.order = append(e.order, clip)
+	e.latest = hash
+
+	if len(e.order) > echoCacheLimit {
+		e.evict(e.order[0])
+		e.order = e.order[1:]
+	}
+}
+
+// Drop clips older than the TTL. The caller must hold e.mu.
+func (e *echoCache) expire(now time.Time) {
+	for len(e.order) > 0 && now.Sub(e.order[0].at) > echoCacheTTL {
+		e.evict(e.order[0])
+		e.order = e.order[1:]
+	}
+}
+
+// Remove a clip from the indexes unless a newer sighting replaced it. The
+// caller must hold e.mu.
+func (e *echoCache) evict(clip *seenClip) {
+	if e.byID[clip.id] == clip {
+		delete(e.byID, clip.id)
+	}
+	if e.byHash[clip.hash] == clip {
+		delete(e.byHash, clip.hash)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	appName    = "Clipy"
+	appVersion = "1.1.0"
+
+	// How long a new client may take to send its hello before it is treated
+	// as a legacy client and starts receiving clips
+	handshakeGrace = 3 * time.Second
+)
+
+// Content types the server can put on and take from the clipboard
+var supportedContentTypes = []string{mimeText, mimePNG}
+
+// Hello is sent by a client as its first message after connecting
+type Hello struct {
+	Name         string   `json:"name"`
+	Platform     string   `json:"platform"`
+	AppVersion   string   `json:"appVersion"`
+	MinVersion   int      `json:"minVersion"`
+	MaxVersion   int      `json:"maxVersion"`
+	ContentTypes []string `json:"contentTypes"`
+	MaxPayload   int64    `json:"maxPayload,omitempty"` // 0 means no limit
+
+	// Either a pairing token from the QR code or a credential from a
+	// previous pairing
+	PairingToken string `json:"pairingToken,omitempty"`
+	DeviceID     string `json:"deviceId,omitempty"`
+	DeviceKey    string `json:"deviceKey,omitempty"`
+
+	// X25519 public key, only sent when pairing, and a random nonce that
+	// salts this session's encryption keys
+	PublicKey    string `json:"publicKey,omitempty"`
+	SessionNonce string `json:"sessionNonce,omitempty"`
+}
+
+// Welcome is the server's answer to a successful hello
+type Welcome struct {
+	Name         string   `json:"name"`
+	Platform     string   `json:"platform"`
+	AppVersion   string   `json:"appVersion"`
+	Version      int      `json:"version"` // Negotiated protocol version
+	ContentTypes []string `json:"contentTypes"`
+	MaxPayload   int64    `json:"maxPayload"`
+
+	// Credential issued when the hello completed a pairing. The client must
+	// store it and present it in every later hello.
+	DeviceID  string `json:"deviceId,omitempty"`
+	DeviceKey string `json:"deviceKey,omitempty"`
+
+	// Server half of the key exchange and session nonce, see Hello
+	PublicKey    string `json:"publicKey,omitempty"`
+	SessionNonce string `json:"sessionNonce,omitempty"`
+}
+
+// ErrorPayload is sent before the server closes a connection it refuses
+type ErrorPayload struct {
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// Error codes sent in ErrorPayload
+const (
+	errCodeUnsupportedVersion = "unsupported_version"
+	errCodeNoContentTypes     = "no_content_types"
+	errCodeHandshakeRequired  = "handshake_required"
+	errCodeBadHello           = "bad_hello"
+	errCodeUnauthorized       = "unauthorized"
+	errCodeE2ERequired        = "e2e_required"
+)
+
+// handshakeError describes why a client was refused
+type handshakeError struct {
+	code   string
+	reason string
+}
+
+func (e *handshakeError) Error() string {
+	return e.reason
+}
+
+// Pick the protocol version and content types both sides support
+func negotiate(h *Hello) (int, []string, error) {
+	minVersion, maxVersion := h.MinVersion, h.MaxVersion
+	if minVersion == 0 {
+		minVersion = 1
+	}
+	if maxVersion == 0 {
+		maxVersion = minVersion
+	}
+
+	version := protocolVersion
+	if maxVersion < version {
+		version = maxVersion
+	}
+	if version < minProtocolVersion || version < minVersion {
+		return 0, nil, &handshakeError{
+			code: errCodeUnsupportedVersion,
+			reason: fmt.Sprintf("client speaks versions %d-%d, server speaks %d-%d",
+				minVersion, maxVersion, minProtocolVersion, protocolVersion),
+		}
+	}
+
+	var types []string
+	for _, t := range h.ContentTypes {
+		for _, s := range supportedContentTypes {
+			if t == s {
+				types = append(types, t)
+				break
+			}
+		}
+	}
+	if len(types) == 0 {
+		return 0, nil, &handshakeError{
+			code:   errCodeNoContentTypes,
+			reason: "client supports none of the server's content types",
+		}
+	}
+
+	return version, types, nil
+}
+
+// Process a hello message and apply the negotiated capabilities to the client
+func handleHello(c *client, msg *Message) error {
+	var h Hello
+	if err := json.Unmarshal(msg.Payload, &h); err != nil {
+		return &handshakeError{code: errCodeBadHello, reason: fmt.Sprintf("invalid hello: %v", err)}
+	}
+
+	version, types, err := negotiate(&h)
+	if err != nil {
+		return err
+	}
+
+	// Authenticate with a stored credential or exchange a pairing token for one
+	deviceID, deviceKey := c.deviceID, ""
+	var encKey []byte
+	var serverPublicKey string
+	switch {
+	case deviceID != "":
+		// Already logged in through the URL, which encrypted devices cannot do
+	case h.DeviceID != "":
+		d := authenticateDevice(h.DeviceID, h.DeviceKey)
+		if d == nil {
+			return &handshakeError{code: errCodeUnauthorized, reason: "unknown device"}
+		}
+		deviceID, encKey = d.ID, d.EncKey
+	case c.pairing || h.PairingToken != "":
+		secret, ok := c.pairingSecret, c.pairing
+		if !ok {
+			secret, ok = consumePairingToken(h.PairingToken)
+		}
+		if !ok {
+			return &handshakeError{code: errCodeUnauthorized, reason: "device is not paired"}
+		}
+		if h.PublicKey != "" {
+			key, pub, err := pairingKeyExchange(h.PublicKey, secret)
+			if err != nil {
+				return &handshakeError{code: errCodeBadHello, reason: err.Error()}
+			}
+			encKey, serverPublicKey = key, pub
+		}
+		if encKey == nil && config.RequireE2E {
+			return &handshakeError{code: errCodeE2ERequired, reason: "end-to-end encryption is required"}
+		}
+		id, key, err := pairDevice(h.Name, h.Platform, encKey)
+		if err != nil {
+			return fmt.Errorf("failed to pair device: %v", err)
+		}
+		deviceID, deviceKey = id, key
+		sendNotification("Device Paired", h.Name+" can now sync your clipboard.")
+	default:
+		return &handshakeError{code: errCodeUnauthorized, reason: "device is not paired"}
+	}
+
+	// Devices paired with a key must encrypt every session
+	var sess *session
+	var serverNonce string
+	if encKey != nil {
+		serverNonce = newSessionNonce()
+		var err error
+		sess, err = newSession(encKey, h.SessionNonce, serverNonce)
+		if err != nil {
+			return &handshakeError{code: errCodeBadHello, reason: err.Error()}
+		}
+	} else if config.RequireE2E {
+		return &handshakeError{code: errCodeE2ERequired, reason: "end-to-end encryption is required"}
+	}
+
+	// The user may have renamed the device
+	name := h.Name
+	if registered := markDeviceSeen(deviceID, h.Platform); registered != "" {
+		name = registered
+	}
+
+	welcome := newControlMessage(msgTypeWelcome, Welcome{
+		Name:         appName,
+		Platform:     runtime.GOOS,
+		AppVersion:   appVersion,
+		Version:      version,
+		ContentTypes: supportedContentTypes,
+		MaxPayload:   config.MaxPayload,
+		DeviceID:     deviceID,
+		DeviceKey:    deviceKey,
+		PublicKey:    serverPublicKey,
+		SessionNonce: serverNonce,
+	})
+
+	// Broadcasts send to the client as soon as it counts as handshaked, so
+	// the session is installed and the welcome queued in the same step. The
+	// welcome is never encrypted and goes out before anything sealed; the
+	// client switches on encryption after reading it.
+	clientsMutex.Lock()
+	c.authenticated = true
+	c.deviceID = deviceID
+	c.pairing = false
+	c.handshaked = true
+	c.legacy = false
+	c.name = name
+	c.platform = h.Platform
+	c.appVersion = h.AppVersion
+	c.version = version
+	c.contentTypes = types
+	c.maxPayload = h.MaxPayload
+	c.session = sess
+	data, err := encodeFor(c, welcome)
+	if err == nil && !c.enqueue(websocket.TextMessage, data) {
+		err = fmt.Errorf("client is not keeping up or disconnected")
+	}
+	clientsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[INFO] Handshake with %s (%s, app %s) using protocol v%d, end-to-end encryption: %t\n",
+		name, h.Platform, h.AppVersion, version, sess != nil)
+	return nil
+}
+
+// Tell the client why it is refused and close the connection
+func refuseClient(c *client, err error) {
+	code := errCodeBadHello
+	if he, ok := err.(*handshakeError); ok {
+		code = he.code
+	}
+	fmt.Printf("[INFO] Refusing client: %v\n", err)
+
+	// Legacy clients only understand clips, the close reason has to do
+	if c.legacy {
+		code = ""
+	}
+	if code != "" {
+		if sendErr := sendMessage(c, newControlMessage(msgTypeError, ErrorPayload{Code: code, Reason: err.Error()})); sendErr != nil {
+			fmt.Printf("[ERROR] Failed to send error to client: %v\n", sendErr)
+		}
+	}
+
+	clientsMutex.Lock()
+	c.enqueueClose(websocket.ClosePolicyViolation, err.Error())
+	clientsMutex.Unlock()
+}
+
+// Queue a single message for a client. The clients mutex keeps encryption
+// sequence numbers in the same order as the queue.
+func sendMessage(c *client, msg *Message) error {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	data, err := encodeFor(c, msg)
+	if err != nil {
+		return err
+	}
+	if !c.enqueue(websocket.TextMessage, data) {
+		return fmt.Errorf("client is not keeping up or disconnected")
+	}
+	return nil
+}
+
+// Check whether a clip can be delivered to the client given its capabilities
+func (c *client) accepts(msg *Message) bool {
+	if c.maxPayload > 0 && msg.size() > c.maxPayload {
+		return false
+	}
+	for _, t := range c.contentTypes {
+		if t == msg.MIME {
+			return true
+		}
+	}
+	return false
+}
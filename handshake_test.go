@@ -0,0 +1,60 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name    string
+		hello   Hello
+		version int
+		types   []string
+		code    string
+	}{
+		{"newest", Hello{MinVersion: 1, MaxVersion: protocolVersion + 5, ContentTypes: []string{mimeText, mimePNG}}, protocolVersion, []string{mimeText, mimePNG}, ""},
+		{"older client", Hello{MinVersion: 1, MaxVersion: 2, ContentTypes: []string{mimeText}}, 2, []string{mimeText}, ""},
+		{"no range", Hello{ContentTypes: []string{mimeText}}, 1, []string{mimeText}, ""},
+		{"only max", Hello{MaxVersion: 3, ContentTypes: []string{mimeText}}, 3, []string{mimeText}, ""},
+		{"unknown types dropped", Hello{MaxVersion: protocolVersion, ContentTypes: []string{"text/html", mimePNG}}, protocolVersion, []string{mimePNG}, ""},
+		{"too new", Hello{MinVersion: protocolVersion + 1, MaxVersion: protocolVersion + 2, ContentTypes: []string{mimeText}}, 0, nil, errCodeUnsupportedVersion},
+		{"no common types", Hello{MaxVersion: protocolVersion, ContentTypes: []string{"text/html"}}, 0, nil, errCodeNoContentTypes},
+		{"no types", Hello{MaxVersion: protocolVersion}, 0, nil, errCodeNoContentTypes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, types, err := negotiate(&tt.hello)
+			if tt.code != "" {
+				he, ok := err.(*handshakeError)
+				if !ok || he.code != tt.code {
+					t.Fatalf("got error %v, want code %s", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != tt.version || !slices.Equal(types, tt.types) {
+				t.Fatalf("negotiated v%d %v, want v%d %v", version, types, tt.version, tt.types)
+			}
+		})
+	}
+}
+
+func TestClientAccepts(t *testing.T) {
+	c := &client{contentTypes: []string{mimeText}, maxPayload: 10}
+	if !c.accepts(newClipMessage(mimeText, []byte("short"), "")) {
+		t.Fatal("short text refused")
+	}
+	if c.accepts(newClipMessage(mimeText, []byte("longer than ten bytes"), "")) {
+		t.Fatal("text over the payload limit accepted")
+	}
+	if c.accepts(newClipMessage(mimePNG, []byte{1}, "")) {
+		t.Fatal("image accepted by a text-only client")
+	}
+	c.maxPayload = 0
+	if !c.accepts(newClipMessage(mimeText, []byte("longer than ten bytes"), "")) {
+		t.Fatal("payload limited without a limit")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// Run the server until SIGINT or SIGTERM, for machines without a desktop
+func runHeadless() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Println("[INFO] Running headless, press Enter for a new pairing QR code")
+	startServer()
+
+	// Pairing tokens expire, so let the user ask for a fresh code
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			printPairingQR()
+		}
+	}()
+
+	<-ctx.Done()
+	fmt.Println("[INFO] Received shutdown signal")
+	onExit()
+}
+
+// Print the pairing URL and its QR code to the terminal
+func printPairingQR() {
+	url := pairingURL()
+	qr, err := qrcode.New(url, qrcode.Medium)
+	if err != nil {
+		fmt.Println("[ERROR] Failed to generate QR code:", err)
+		return
+	}
+
+	fmt.Printf("[INFO] Pair a device by scanning this code, valid for %d minutes:\n", int(pairingTokenTTL.Minutes()))
+	fmt.Println(qr.ToSmallString(false))
+	fmt.Println("[INFO] Connection URL:", url)
+}
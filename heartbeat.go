@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Ping the client every config.PingInterval until the connection closes.
+// Gorilla lets WriteControl run alongside the writer goroutine, so pings are
+// not held up behind a long transfer.
+func (c *client) startHeartbeat() {
+	interval := time.Duration(config.PingInterval)
+	writeTimeout := time.Duration(config.WriteTimeout)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+					return // The reader notices the connection is gone
+				}
+			}
+		}
+	}()
+}
+
+// Give the client until the next ping plus config.PongTimeout to show it is
+// alive. Called on every pong and message, so reads fail once it goes quiet.
+// Only the connection's reader may call it.
+func (c *client) keepAlive() {
+	c.conn.SetReadDeadline(time.Now().Add(time.Duration(config.PingInterval + config.PongTimeout)))
+}
+
+// Whether a read failed because the client stopped answering
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	historyFile    = "history.json"
+	historyBlobDir = "history" // Images are kept as files next to the index
+)
+
+// A clipboard item copied locally or received from a device
+type historyItem struct {
+	ID         string    `json:"id"`
+	Hash       string    `json:"hash"` // SHA-256 of the MIME type and content, used to deduplicate
+	MIME       string    `json:"mime"`
+	Text       string    `json:"text,omitempty"`
+	BlobFile   string    `json:"blobFile,omitempty"`
+	Size       int       `json:"size"`
+	Width      int       `json:"width,omitempty"`
+	Height     int       `json:"height,omitempty"`
+	Origin     string    `json:"origin"`
+	OriginName string    `json:"originName"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// Persistent clipboard history, newest item first
+type historyStore struct {
+	mu    sync.Mutex
+	dir   string
+	limit int
+	items []*historyItem
+}
+
+var history *historyStore
+
+// Called after a clip is recorded, used by the tray to refresh its menu
+var onHistoryChanged func()
+
+// Open the history stored in dir, creating it if needed
+func openHistory(dir string, limit int) (*historyStore, error) {
+	if limit < 1 {
+		return nil, fmt.Errorf("history limit must be at least 1, got %d", limit)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, historyBlobDir), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %v", err)
+	}
+
+	h := &historyStore{dir: dir, limit: limit}
+	data, err := os.ReadFile(filepath.Join(dir, historyFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read history: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &h.items); err != nil {
+			return nil, fmt.Errorf("failed to parse history: %v", err)
+		}
+	}
+
+	// Apply a retention limit lowered since the last run
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.prune() {
+		if err := h.save(); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// Record a clipboard item. Content already in the history is moved to the
+// top instead of being stored twice.
+func (h *historyStore) add(mime string, data []byte, origin, originName string) (*historyItem, error) {
+	hash := contentHash(mime, data)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, item := range h.items {
+		if item.Hash == hash {
+			item.Origin, item.OriginName, item.CreatedAt = origin, originName, time.Now()
+			copy(h.items[1:i+1], h.items[:i])
+			h.items[0] = item
+			return item, h.save()
+		}
+	}
+
+	item := &historyItem{
+		ID:         newMessageID(),
+		Hash:       hash,
+		MIME:       mime,
+		Size:       len(data),
+		Origin:     origin,
+		OriginName: originName,
+		CreatedAt:  time.Now(),
+	}
+	if mime == mimeText {
+		item.Text = string(data)
+	} else {
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			item.Width, item.Height = cfg.Width, cfg.Height
+		}
+		item.BlobFile = item.ID + blobExtension(mime)
+		if err := os.WriteFile(filepath.Join(h.dir, historyBlobDir, item.BlobFile), data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to store history item: %v", err)
+		}
+	}
+
+	h.items = append([]*historyItem{item}, h.items...)
+	h.prune()
+	return item, h.save()
+}
+
+// Return copies of up to n of the most recent items
+func (h *historyStore) recent(n int) []*historyItem {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var items []*historyItem
+	for i := 0; i < n && i < len(h.items); i++ {
+		item := *h.items[i]
+		items = append(items, &item)
+	}
+	return items
+}
+
+// Return copies of the items, newest first, whose text or origin contains every word
+// of the query, ignoring case. An empty query matches everything.
+func (h *historyStore) search(query string, limit int) []*historyItem {
+	words := strings.Fields(strings.ToLower(query))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var results []*historyItem
+	for _, item := range h.items {
+		haystack := strings.ToLower(item.Text + "\x00" + item.OriginName + "\x00" + item.MIME)
+		matched := true
+		for _, w := range words {
+			if !strings.Contains(haystack, w) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			found := *item
+			results = append(results, &found)
+			if limit > 0 && len(results) == limit {
+				break
+			}
+		}
+	}
+	return results
+}
+
+// Return a copy of the item with the given ID, or nil
+func (h *historyStore) get(id string) *historyItem {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, item := range h.items {
+		if item.ID == id {
+			found := *item
+			return &found
+		}
+	}
+	return nil
+}
+
+// Return the content of an item
+func (h *historyStore) content(item *historyItem) ([]byte, error) {
+	if item.BlobFile == "" {
+		return []byte(item.Text), nil
+	}
+	data, err := os.ReadFile(filepath.Join(h.dir, historyBlobDir, item.BlobFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history item: %v", err)
+	}
+	return data, nil
+}
+
+// Drop items beyond the retention limit. The caller must hold h.mu.
+func (h *historyStore) prune() bool {
+	if len(h.items) <= h.limit {
+		return false
+	}
+	for _, item := range h.items[h.limit:] {
+		if item.BlobFile != "" {
+			os.Remove(filepath.Join(h.dir, historyBlobDir, item.BlobFile))
+		}
+	}
+	h.items = h.items[:h.limit]
+	return true
+}
+
+// Write the index to disk. The caller must hold h.mu.
+func (h *historyStore) save() error {
+	data, err := json.Marshal(h.items)
+	if err != nil {
+		return fmt.Errorf("failed to encode history: %v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(h.dir, historyFile), data); err != nil {
+		return fmt.Errorf("failed to write history: %v", err)
+	}
+	return nil
+}
+
+func blobExtension(mime string) string {
+	if mime == mimePNG {
+		return ".png"
+	}
+	return ".bin"
+}
+
+// Record a clip in the history, logging instead of failing the sync
+func recordHistory(mime string, data []byte, origin, originName string) {
+	if history == nil {
+		return
+	}
+	if _, err := history.add(mime, data, origin, originName); err != nil {
+		fmt.Println("[ERROR] Failed to record clipboard history:", err)
+	}
+	if onHistoryChanged != nil {
+		onHistoryChanged()
+	}
+}
+
+// Serve the history as JSON on the local-only page server. Supports
+// ?q= for search, ?limit= to cap results and ?id= to fetch one item's content.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if history == nil {
+		http.Error(w, "history is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	if id := r.URL.Query().Get("id"); id != "" {
+		item := history.get(id)
+		if item == nil {
+			http.NotFound(w, r)
+			return
+		}
+		data, err := history.content(item)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", item.MIME)
+		w.Write(data)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	results := history.search(r.URL.Query().Get("q"), limit)
+	if results == nil {
+		results = []*historyItem{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
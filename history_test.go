@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHistoryDeduplicates(t *testing.T) {
+	h, err := openHistory(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := h.add(mimeText, []byte("same"), "phone", "Phone")
+	h.add(mimeText, []byte("other"), localDeviceID, "This PC")
+	again, err := h.add(mimeText, []byte("same"), localDeviceID, "This PC")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Copied again, the item moves to the top with its new origin
+	if again.ID != first.ID {
+		t.Fatal("same content stored twice")
+	}
+	items := h.recent(10)
+	if len(items) != 2 || items[0].ID != first.ID || items[0].OriginName != "This PC" || items[1].Text != "other" {
+		t.Fatalf("history after a repeated copy: %+v", items)
+	}
+
+	// The same bytes as another type are another item
+	if img, _ := h.add(mimePNG, []byte("same"), "phone", "Phone"); img.ID == first.ID {
+		t.Fatal("image deduplicated against text")
+	}
+}
+
+func TestHistoryRetentionAndPersistence(t *testing.T) {
+	dir := t.TempDir()
+	h, err := openHistory(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := h.add(mimePNG, largePNG(t), "phone", "Phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Width != 400 || img.Height != 400 || img.BlobFile == "" {
+		t.Fatalf("image item %+v", img)
+	}
+	blob := filepath.Join(dir, historyBlobDir, img.BlobFile)
+	if data, err := h.content(img); err != nil || !bytes.Equal(data, largePNG(t)) {
+		t.Fatalf("image content not kept: %v", err)
+	}
+	for _, text := range []string{"one", "two", "three"} {
+		h.add(mimeText, []byte(text), localDeviceID, "This PC")
+	}
+
+	// The oldest item and its file are dropped past the limit
+	if h.get(img.ID) != nil {
+		t.Fatal("item kept past the retention limit")
+	}
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Fatal("image file kept past the retention limit")
+	}
+
+	// Reopened with a lower limit, as after a restart with a new config
+	h, err = openHistory(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := h.recent(10)
+	if len(items) != 2 || items[0].Text != "three" || items[1].Text != "two" {
+		t.Fatalf("history after reopening: %+v", items)
+	}
+
+	if _, err := openHistory(dir, 0); err == nil {
+		t.Fatal("history opened without a limit")
+	}
+}
+
+func TestHistorySearch(t *testing.T) {
+	h, err := openHistory(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.add(mimeText, []byte("Meeting notes for Monday"), localDeviceID, "This PC")
+	h.add(mimeText, []byte("grocery list"), "phone", "Pixel")
+	h.add(mimeText, []byte("monday standup link"), "phone", "Pixel")
+	h.add(mimePNG, []byte("not decoded"), "phone", "Pixel")
+
+	tests := []struct {
+		query string
+		limit int
+		want  []string
+	}{
+		{"monday", 0, []string{"monday standup link", "Meeting notes for Monday"}},
+		{"MONDAY pixel", 0, []string{"monday standup link"}},
+		{"monday notes", 0, []string{"Meeting notes for Monday"}},
+		{"image/png", 0, []string{""}},
+		{"nothing like it", 0, nil},
+		{"", 2, []string{"", "monday standup link"}},
+	}
+	for _, tt := range tests {
+		results := h.search(tt.query, tt.limit)
+		var got []string
+		for _, item := range results {
+			got = append(got, item.Text)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("search %q found %q, want %q", tt.query, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("search %q found %q, want %q", tt.query, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestHistoryPage(t *testing.T) {
+	saved := history
+	t.Cleanup(func() { history = saved })
+	var err error
+	if history, err = openHistory(t.TempDir(), 10); err != nil {
+		t.Fatal(err)
+	}
+	item, _ := history.add(mimeText, []byte("find me"), localDeviceID, "This PC")
+	history.add(mimeText, []byte("something else"), localDeviceID, "This PC")
+
+	rec := httptest.NewRecorder()
+	handleHistory(rec, httptest.NewRequest(http.MethodGet, "/history?q=find", nil))
+	var results []historyItem
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ID != item.ID {
+		t.Fatalf("search page returned %+v", results)
+	}
+
+	rec = httptest.NewRecorder()
+	handleHistory(rec, httptest.NewRequest(http.MethodGet, "/history?id="+item.ID, nil))
+	if rec.Body.String() != "find me" || rec.Header().Get("Content-Type") != mimeText {
+		t.Fatalf("item page returned %q as %s", rec.Body, rec.Header().Get("Content-Type"))
+	}
+
+	rec = httptest.NewRecorder()
+	handleHistory(rec, httptest.NewRequest(http.MethodGet, "/history?id=unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown item answered %d", rec.Code)
+	}
+}
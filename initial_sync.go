@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// What happens right after a device says hello
+const (
+	syncPushLatest = "push-latest"      // Send the device what the PC clipboard holds
+	syncPullDevice = "pull-from-device" // Ask the device for what its clipboard holds
+	syncNone       = "none"             // Wait for the next copy on either side
+)
+
+var initialSyncModes = []string{syncPushLatest, syncPullDevice, syncNone}
+
+// Bring a device that just said hello up to date, according to
+// config.InitialSync. sent are the IDs of clips it already got on connecting,
+// from a resumed transfer or its outbox, which are not sent again.
+func (s *Server) initialSync(c *client, sent ...string) {
+	if !s.syncing() {
+		return
+	}
+	switch config.InitialSync {
+	case syncPushLatest:
+		msg, hash, broadcast := s.currentClip()
+		if msg == nil || broadcast || slices.Contains(sent, msg.ID) {
+			return
+		}
+		fmt.Printf("[INFO] Sending the current clip to %s\n", c.displayName())
+		s.sendClip(c, msg, hash)
+	case syncPullDevice:
+		if settings := deviceSettingsFor(c.deviceID); c.version < requestVersion || settings.Disabled || settings.Direction == directionToDevice {
+			return
+		}
+		if err := sendMessage(c, newControlMessage(msgTypeRequest, nil)); err != nil {
+			fmt.Printf("[ERROR] Failed to ask %s for its clip: %v\n", c.displayName(), err)
+		}
+	}
+}
+
+// Answer a device asking for the current clip
+func (s *Server) handleRequest(c *client) {
+	if !s.syncing() {
+		fmt.Println("[INFO] Sync is paused, ignoring request from", c.displayName())
+		return
+	}
+	msg, hash, broadcast := s.currentClip()
+	if msg == nil {
+		fmt.Printf("[INFO] %s asked for the current clip, the clipboard is empty\n", c.displayName())
+		return
+	}
+	if broadcast {
+		return // It just went to every device
+	}
+	s.sendClip(c, msg, hash)
+}
+
+// Send the current clip to a single device, on the user's request
+func (s *Server) pushCurrentClip(c *client) {
+	if !s.syncing() {
+		fmt.Println("[INFO] Sync is paused, not sending the current clip to", c.displayName())
+		return
+	}
+	msg, hash, broadcast := s.currentClip()
+	if msg == nil {
+		fmt.Println("[INFO] The clipboard is empty, nothing to send to", c.displayName())
+		return
+	}
+	if broadcast {
+		return // It just went to every device
+	}
+	fmt.Printf("[INFO] Sending the current clip to %s\n", c.displayName())
+	s.sendClip(c, msg, hash)
+}
+
+// The clip the clipboard holds, with the ID and version it was copied or
+// applied with, and its content hash. Returns nil if the clipboard is empty.
+// broadcast reports a copy the monitor had not seen yet, which was just sent
+// to every device, so callers need not send it again.
+func (s *Server) currentClip() (msg *Message, hash string, broadcast bool) {
+	s.clipMu.Lock()
+	defer s.clipMu.Unlock()
+
+	// Pick up a copy the monitor has not seen yet, so it gets a version
+	broadcast = s.checkClipboardLocked()
+	mime, data := s.readClipboard()
+	if mime == "" {
+		return nil, "", false
+	}
+
+	// What the clipboard held when the server started has no version yet
+	if s.currentID == "" {
+		stamp := s.clock.Now()
+		s.current = clipVersion{Clock: stamp, Origin: localDeviceID}
+		s.currentID = newMessageID()
+	}
+	msg = newClipMessage(mime, data, s.current.Origin)
+	msg.ID = s.currentID
+	stamp := s.current.Clock
+	msg.Clock = &stamp
+	return msg, contentHash(mime, data), broadcast
+}
+
+// Send a clip to a single device
+func (s *Server) sendClip(c *client, msg *Message, hash string) {
+	if !deviceSettingsFor(c.deviceID).receives(msg.MIME) {
+		fmt.Printf("[INFO] Not sending %s a %s clip, its settings do not allow it\n", c.displayName(), msg.MIME)
+		return
+	}
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	if !c.accepts(msg) {
+		fmt.Printf("[INFO] Not sending %s a %s clip of %d bytes it does not accept\n", c.displayName(), msg.MIME, msg.size())
+		return
+	}
+	if newClipEncodings(msg).sendTo(c, s.transfers) {
+		s.echoes.delivered(hash, []string{c.echoKey()})
+	}
+}
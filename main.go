@@ -2,66 +2,164 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"flag"
 	"fmt"
+	"html"
 	"image"
 	"image/png"
-	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gen2brain/beeep"
-	"github.com/getlantern/systray"
 	"github.com/gorilla/websocket"
 	"github.com/skip2/go-qrcode"
-	"golang.design/x/clipboard"
 )
 
 var (
-	clients               = make(map[*websocket.Conn]bool)
-	clientsMutex          sync.Mutex
-	lastClipboardContent  string
-	isServerRunning       = false
-	paused                = false // A flag to control pause/resume
-	stopMonitoring        = make(chan bool)
-	httpServer            *http.Server      // HTTP server instance
-	notificationsEnabled  = true            // Flag to enable/disable notifications
-	notificationsMenuItem *systray.MenuItem // Menu item to toggle notifications
+	clients              = make(map[*websocket.Conn]*client)
+	clientsMutex         sync.Mutex
+	notificationsEnabled atomic.Bool // Toggled from the tray, read everywhere
 )
 
-var statusMenuItem *systray.MenuItem
-var connectedDevicesMenuItem *systray.MenuItem
+// A connected device
+type client struct {
+	conn        *websocket.Conn
+	connectedAt time.Time
+	legacy      bool // Client speaks the legacy "text:"/"image:" format
+	handshaked  bool // Client completed the hello/welcome exchange
+
+	// Pairing state, clips are only exchanged with authenticated clients
+	authenticated bool
+	deviceID      string // Set once the client is a known paired device
+	pairing       bool   // Client presented a pairing token and awaits a credential
+	pairingSecret string // Issued with that token, authenticates the key exchange
+
+	// Capabilities declared in the hello, legacy clients keep the defaults
+	name         string
+	platform     string
+	appVersion   string
+	version      int
+	contentTypes []string
+	maxPayload   int64
+
+	session *session // End-to-end encryption, nil for unencrypted clients
+
+	traffic   connTraffic // Added to the device's stats when it disconnects
+	announced bool        // Its connection was reported, guarded by clientsMutex
+
+	// Outbound frames, written by the client's own writer goroutine
+	send       chan frame
+	done       chan struct{}
+	writerDone chan struct{} // Closed once the writer has closed the connection
+	closeOnce  sync.Once
+}
 
-const (
-	port = "8080"
-)
+// Name shown for the client in logs and history
+func (c *client) displayName() string {
+	if c.name != "" {
+		return c.name
+	}
+	return "Android device"
+}
+
+// The client as a recipient of a clip. The caller must hold clientsMutex.
+func (c *client) recipient() recipient {
+	return recipient{deviceID: c.deviceID, echoKey: c.echoKey(), name: c.displayName(), receipts: c.version >= receiptVersion}
+}
+
+// Key of the client in the echo cache. Clients that paired through the URL
+// without a hello have no device ID, so each connection counts on its own.
+func (c *client) echoKey() string {
+	if c.deviceID != "" {
+		return c.deviceID
+	}
+	return fmt.Sprintf("connection %p", c)
+}
 
 // Start the application
 func main() {
+	cfg, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Println("[ERROR] Invalid configuration:", err)
+		os.Exit(2)
+	}
+	config = cfg
+	notificationsEnabled.Store(config.Notifications)
+
+	if !trayAvailable && !config.Headless {
+		fmt.Println("[INFO] Built without system tray support, running headless")
+		config.Headless = true
+	}
+
 	// go func() {
 	// 	sendNotification("Clipy", "Checking if another instance is running or port is busy...")
 	// }()
-	if isPortInUse(port) {
-		sendNotification("Clipy", "The port 8080 is busy. Close the application using the port to start the application again.")
+	if isPortInUse(config.Port) {
+		sendNotification("Clipy", fmt.Sprintf("The port %d is busy. Close the application using the port to start the application again.", config.Port))
 		// try removing the lock file if exists
 		os.Exit(1)
 	}
 
+	cb, err := newClipboard(config.Clipboard, config.ClipboardDir)
+	if err != nil {
+		fmt.Println("[ERROR] Failed to open clipboard:", err)
+		sendNotification("Clipy", "Failed to open clipboard: "+err.Error())
+		os.Exit(1)
+	}
+	fmt.Println("[INFO] Using clipboard backend:", cb.Name())
+	server = newServer(cb)
+
+	// Load paired devices before any client can connect
+	if err := loadPairedDevices(); err != nil {
+		fmt.Println("[ERROR] Failed to load paired devices:", err)
+		sendNotification("Clipy", "Failed to load paired devices: "+err.Error())
+		os.Exit(1)
+	}
+
+	if config.Plain {
+		fmt.Println("[WARN] Plain mode enabled, clipboard contents are sent unencrypted")
+	} else if err := loadCertificate(); err != nil {
+		fmt.Println("[ERROR] Failed to load TLS certificate:", err)
+		sendNotification("Clipy", "Failed to load TLS certificate: "+err.Error())
+		os.Exit(1)
+	}
+
+	// Clipboard history is optional, sync keeps working without it
+	if dir, err := configDir(); err != nil {
+		fmt.Println("[ERROR] Failed to open clipboard history:", err)
+	} else if history, err = openHistory(dir, config.HistoryLimit); err != nil {
+		fmt.Println("[ERROR] Failed to open clipboard history:", err)
+	}
+	http.HandleFunc("/history", handleHistory)
+	http.HandleFunc("/devices", handleDevices)
+
+	if config.Headless {
+		runHeadless()
+		return
+	}
+
 	// Start the system tray and wait for it to exit
 	go startSystemTray()
 	// Block main goroutine to keep the application alive
 	select {}
 }
-func isPortInUse(port string) bool {
+func isPortInUse(port int) bool {
 	// Try to listen on the specified port
-	ln, err := net.Listen("tcp", ":"+port)
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		// Port is in use
 		return true
@@ -70,394 +168,636 @@ func isPortInUse(port string) bool {
 	return false
 }
 
-// Start the system tray
-func startSystemTray() {
-	systray.Run(onReady, onExit)
-}
-
-// Initialize system tray options
-func onReady() {
-	systray.SetIcon(getIcon())
-	systray.SetTitle("Clipboard Sync")
-	systray.SetTooltip("Clipboard Sync Server")
-
-	// Add the new status items
-	statusMenuItem = systray.AddMenuItem("Server Status: Paused", "Displays the current status of the server")
-	connectedDevicesMenuItem = systray.AddMenuItem("Connected Devices: 0", "Displays the number of connected devices")
-
-	// Add menu items
-	startMenuItem := systray.AddMenuItem("Start sync", "Start the Clipboard Sync server")
-	stopMenuItem := systray.AddMenuItem("Stop sync", "Stop the Clipboard Sync server")
-	openQRMenuItem := systray.AddMenuItem("Open QR", "Open the QR code page in browser")
-
-	// Add the toggle notifications button
-	notificationsMenuItem = systray.AddMenuItem("Disable Notifications", "Toggle notifications on/off")
-
-	// Add the exit button
-	exitMenuItem := systray.AddMenuItem("Exit", "Exit the application")
-
-	// Start the server on first launch
-	startServer()
-
-	// Initially disable the stop button and enable the start button based on server state
-	updateMenuItemsState(startMenuItem, stopMenuItem)
-
-	// Handle menu item clicks
-	go func() {
-		for {
-			select {
-			case <-startMenuItem.ClickedCh:
-				fmt.Println("[INFO] Start menu clicked")
-				if paused {
-					resumeServer() // Resume the server if it's paused
-				} else {
-					startServer() // Start the server if it's not running
-				}
-				// Update the state of the menu items after starting the server
-				updateMenuItemsState(startMenuItem, stopMenuItem)
-
-			case <-stopMenuItem.ClickedCh:
-				fmt.Println("[INFO] Stop menu clicked")
-				stopServer() // Pause the server
-				// Update the state of the menu items after stopping the server
-				updateMenuItemsState(startMenuItem, stopMenuItem)
-
-			case <-openQRMenuItem.ClickedCh:
-				fmt.Println("[INFO] Open QR menu clicked")
-				openQRCodePage()
-
-			case <-exitMenuItem.ClickedCh:
-				fmt.Println("[INFO] Exit menu clicked")
-				onExit() // Cleanup and exit the application
-				// os.Exit(0) // Exit the application
-				return
-
-			case <-notificationsMenuItem.ClickedCh:
-				toggleNotifications() // Toggle notifications on or off
-			}
-		}
-	}()
-}
-
-// Function to update the status in the menu
-func updateServerStatus() {
-	if paused {
-		statusMenuItem.SetTitle("Server Status: Paused")
-	} else if isServerRunning {
-		statusMenuItem.SetTitle("Server Status: Running")
-	} else {
-		statusMenuItem.SetTitle("Server Status: Stopped")
+// Start the WebSocket server and clipboard monitoring, then show how to pair
+func startServer() {
+	fmt.Println("[INFO] Starting server and clipboard monitoring")
+	if err := server.Start(); err != nil {
+		fmt.Println("[ERROR] Failed to start server:", err)
+		sendNotification("Clipy", "Failed to start server: "+err.Error())
+		return
 	}
-}
 
-// Function to update the number of connected devices
-func updateConnectedDevices() {
-	clientsMutex.Lock()
-	connectedDevicesMenuItem.SetTitle(fmt.Sprintf("Connected Devices: %d", len(clients)))
-	clientsMutex.Unlock()
-}
-
-// Update the menu items' enabled/disabled state
-func updateMenuItemsState(startMenuItem, stopMenuItem *systray.MenuItem) {
-	if paused {
-		startMenuItem.Enable() // Enable "Start" button if server is paused
-		stopMenuItem.Disable() // Disable "Stop" button if server is paused
-	} else if isServerRunning {
-		startMenuItem.Disable() // Disable "Start" button if server is running
-		stopMenuItem.Enable()   // Enable "Stop" button if server is running
+	// Optionally open QR page after server starts
+	if config.Headless {
+		startLocalPages()
+		printPairingQR()
 	} else {
-		startMenuItem.Enable() // Enable "Start" button if the server is not running
-		stopMenuItem.Disable() // Disable "Stop" button if the server is not running
+		openQRCodePage()
 	}
-
-	// Update the status and connected devices info
-	updateServerStatus()
-	updateConnectedDevices()
 }
 
-// Start the WebSocket server and clipboard monitoring
-func startServer() {
-	if isServerRunning {
-		fmt.Println("[INFO] Server is already running")
-		sendNotification("Running", "Server is already running")
+// Stop the server and disconnect every device
+func stopServer() {
+	fmt.Println("[INFO] Stopping server")
+	if err := server.Stop(); err != nil {
+		fmt.Println("[ERROR] Failed to stop server:", err)
 		return
 	}
-	if err := clipboard.Init(); err != nil {
-		fmt.Printf("Failed to initialize clipboard: %v", err)
-	}
-
-	isServerRunning = true
-	fmt.Println("[INFO] Starting server and clipboard monitoring")
-
-	// Reinitialize channels
-	stopMonitoring = make(chan bool)
-
-	// Start WebSocket server and clipboard monitoring in separate goroutines
-	go startWebSocketServer()
-	go monitorClipboardChanges()
-
-	// Optionally open QR page after server starts
-	openQRCodePage()
+	fmt.Println("[INFO] Server stopped")
+	sendNotification("Stopped", "Clipy server stopped, devices were disconnected")
 }
 
-// Stop the clipboard monitoring (pause)
-func stopServer() {
-	if !isServerRunning {
-		fmt.Println("[INFO] Server is not running")
+// Stop exchanging clips while keeping devices connected
+func pauseSync() {
+	fmt.Println("[INFO] Pausing clipboard sync")
+	if err := server.Pause(); err != nil {
+		fmt.Println("[INFO] Not pausing:", err)
 		return
 	}
-
-	paused = true // Set the flag to paused
-	fmt.Println("[INFO] Pausing server and clipboard monitoring")
-
-	// Send stop signal to clipboard monitoring
-	stopMonitoring <- true
 	sendNotification("Paused", "Clipboard syncing paused")
 }
 
-// Resume clipboard monitoring
-func resumeServer() {
-	if !isServerRunning || !paused {
-		fmt.Println("[INFO] Server is already running or not paused")
+// Exchange clips again after a pause
+func resumeSync() {
+	fmt.Println("[INFO] Resuming clipboard sync")
+	if err := server.Resume(); err != nil {
+		fmt.Println("[INFO] Not resuming:", err)
 		return
 	}
-
-	paused = false // Set the flag to resume
-	fmt.Println("[INFO] Resuming clipboard monitoring")
-
-	// Start clipboard monitoring again
-	go monitorClipboardChanges()
 	sendNotification("Resumed", "Clipboard syncing resumed")
 }
 
-// Start the WebSocket server
-func startWebSocketServer() {
-	// Get the specific local IP address
-	ip := getLocalIP()
-	if ip == "" {
-		fmt.Println("[ERROR] Could not determine local IP address")
-		return
+// Handle a WebSocket connection from a device
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	s.handlers.Add(1)
+	defer s.handlers.Done()
+
+	// Clients may authenticate in the URL, which is how legacy clients
+	// pair by scanning the QR code; everyone else does it in the hello
+	query := r.URL.Query()
+	var deviceID, pairingSecret string
+	pairingRequested := false
+	if token := query.Get("pair"); token != "" {
+		secret, ok := consumePairingToken(token)
+		if !ok {
+			fmt.Println("[INFO] Rejected connection with invalid or expired pairing token")
+			http.Error(w, "invalid or expired pairing token", http.StatusUnauthorized)
+			return
+		}
+		pairingRequested = true
+		// A pairing secret sent back in the URL can no longer authenticate
+		// a key exchange, legacy clients pass on the whole QR code
+		if query.Get("ks") == "" {
+			pairingSecret = secret
+		}
+	} else if id := query.Get("device"); id != "" {
+		if authenticateDevice(id, query.Get("key")) == nil {
+			fmt.Println("[INFO] Rejected connection with unknown device credential")
+			http.Error(w, "unknown device", http.StatusUnauthorized)
+			return
+		}
+		// The URL carries no session nonce, so without a hello there would
+		// be no session and clips would go out in plaintext
+		if deviceEncrypted(id) {
+			fmt.Println("[INFO] Rejected URL login of a device paired with end-to-end encryption")
+			http.Error(w, "device uses end-to-end encryption, log in with a hello", http.StatusUnauthorized)
+			return
+		}
+		deviceID = id
 	}
 
-	// Start the WebSocket server on the local IP address
-	address := fmt.Sprintf("%s:8080", ip)
-	fmt.Printf("[INFO] Starting WebSocket server on ws://%s/ws\n", address)
-
-	// Create a new WebSocket upgrader with custom origin check
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Println("[ERROR] WebSocket upgrade error:", err)
+		return
 	}
-
-	// Create a new HTTP multiplexer and handle WebSocket connections
-	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			fmt.Println("[ERROR] WebSocket upgrade error:", err)
-			return
+	conn.SetReadLimit(config.MaxPayload)
+
+	// Assume a legacy client until it sends a hello
+	c := &client{
+		conn:          conn,
+		connectedAt:   time.Now(),
+		legacy:        true,
+		contentTypes:  supportedContentTypes,
+		authenticated: pairingRequested || deviceID != "",
+		deviceID:      deviceID,
+		pairing:       pairingRequested,
+		pairingSecret: pairingSecret,
+	}
+	if deviceID != "" {
+		c.name = markDeviceSeen(deviceID, "")
+	}
+	c.startWriter()
+	defer recordDeviceVisit(c) // After the writer is done, so its traffic is counted
+	defer c.finish()
+	defer s.transfers.park(c)
+
+	// Unauthenticated clients must pair or log in with their hello in time,
+	// everyone else must keep answering pings
+	if c.authenticated {
+		c.keepAlive()
+	} else {
+		conn.SetReadDeadline(time.Now().Add(handshakeGrace))
+	}
+	conn.SetPongHandler(func(string) error {
+		if c.authenticated {
+			c.keepAlive()
 		}
-		defer conn.Close()
+		return nil
+	})
+	c.startHeartbeat()
+	clientsMutex.Lock()
+	if r.Context().Err() != nil {
+		// The server stopped while this client was connecting
+		c.enqueueClose(websocket.CloseGoingAway, stopReason)
+		clientsMutex.Unlock()
+		return
+	}
+	clients[conn] = c
+	clientsMutex.Unlock()
 
+	// Devices are announced by name once they said hello. Clients that never
+	// do are announced when they start being treated as legacy clients, and
+	// are brought up to date then like devices after their hello.
+	legacyDone := make(chan struct{})
+	legacyTimer := time.AfterFunc(handshakeGrace, func() {
+		defer close(legacyDone)
+		announceClient(c)
 		clientsMutex.Lock()
-		clients[conn] = true
+		legacy := !c.handshaked && clients[conn] == c
 		clientsMutex.Unlock()
+		if legacy {
+			s.initialSync(c, s.flushOutbox(c)...)
+		}
+	})
+	defer func() {
+		// Stopping the server waits for handlers, so also for the timer
+		if !legacyTimer.Stop() {
+			<-legacyDone
+		}
+	}()
 
-		// Update the number of connected devices
-		updateConnectedDevices()
-
-		fmt.Printf("[INFO] Client connected. Total clients: %d\n", len(clients))
-		sendNotification("Device Connected", "Total devices: "+fmt.Sprint(len(clients)))
+	// Handle WebSocket messages until the client disconnects or the server stops
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			// Client disconnected, stopped answering pings or error reading message
+			if c.authenticated && isTimeout(err) {
+				fmt.Printf("[INFO] %s stopped responding, disconnecting\n", c.displayName())
+			}
+			removeClient(conn)
+			c.disconnect() // Whatever is still queued cannot reach it
+			return         // Break the loop once the client disconnects
+		}
+		c.traffic.bytesReceived.Add(int64(len(message)))
+		if c.authenticated {
+			c.keepAlive()
+		}
 
-		// Handle WebSocket messages
-		for {
-			// Check for paused state
-			if paused {
-				time.Sleep(1 * time.Second) // Wait while paused
+		// Binary frames carry the chunks of transfers the client offered
+		if messageType == websocket.BinaryMessage {
+			if !c.handshaked {
 				continue
 			}
+			c.receiveChunk(s.transfers, message)
+			continue
+		}
 
-			select {
-			case <-stopMonitoring:
-				fmt.Println("[INFO] WebSocket server shutting down.")
+		// Process received message
+		msg, legacy, err := decodeMessage(message)
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to decode message: %v\n", err)
+			if strings.HasPrefix(string(message), legacyImagePrefix) {
+				sendNotification("Image Error", "Wrong image format received. Must be PNG.")
+			}
+			continue
+		}
+
+		// The first message decides how the client is treated: a hello
+		// negotiates capabilities, a legacy string downgrades the client
+		// and any other envelope is refused.
+		if !c.handshaked && legacy && !c.authenticated {
+			refuseClient(c, &handshakeError{code: errCodeUnauthorized, reason: "device is not paired"})
+			removeClient(conn)
+			return
+		}
+		if !c.handshaked && legacy && config.RequireE2E {
+			refuseClient(c, &handshakeError{code: errCodeE2ERequired, reason: "end-to-end encryption is required"})
+			removeClient(conn)
+			return
+		}
+		if !c.handshaked && !legacy {
+			clientsMutex.Lock()
+			c.legacy = false
+			clientsMutex.Unlock()
+
+			var err error = &handshakeError{code: errCodeHandshakeRequired, reason: "hello expected as first message"}
+			if msg.Type == msgTypeHello {
+				err = handleHello(c, msg)
+			}
+			if err != nil {
+				refuseClient(c, err)
+				removeClient(conn)
 				return
-			default:
-				_, message, err := conn.ReadMessage()
-				if err != nil {
-					// Client disconnected or error reading message
-					clientsMutex.Lock()
-					delete(clients, conn) // Remove client from the map
-					clientsMutex.Unlock()
-
-					// Update the number of connected devices
-					updateConnectedDevices()
-
-					// Send notification if the client is disconnected
-					fmt.Printf("[INFO] Client disconnected. Total clients: %d\n", len(clients))
-					sendNotification("Device Disconnected", "Total devices: "+fmt.Sprint(len(clients)))
-					return // Break the loop once the client disconnects
-				}
+			}
+			c.keepAlive()
+			announceClient(c)
+			resumed := s.resumeTransfer(c)
+			s.initialSync(c, append(s.flushOutbox(c), resumed)...)
+			continue
+		}
 
-				// Process received message
-				content := string(message)
-				fmt.Printf("[INFO] Clipboard received from client: %s\n", content)
+		// Clients with an encrypted session may not send plaintext clips
+		if c.session != nil && (msg.Enc != "" || sealedType(msg.Type)) {
+			msg, err = c.session.open(msg)
+			if err != nil {
+				fmt.Printf("[ERROR] Rejected message from client: %v\n", err)
+				continue
+			}
+		} else if msg.Enc != "" {
+			fmt.Println("[ERROR] Rejected encrypted message from client without a session")
+			continue
+		}
 
-				if strings.HasPrefix(content, "text:") {
-					textContent := strings.TrimPrefix(content, "text:")
+		// Large clips arrive as chunked transfers and continue as a clip once complete
+		switch {
+		case msg.Type == msgTypeClip:
+		case c.version >= transferVersion && isTransferType(msg.Type):
+			if msg = c.handleTransfer(s.transfers, msg); msg == nil {
+				continue
+			}
+		case c.version >= receiptVersion && msg.Type == msgTypeReceipt:
+			s.deliveries.report(c, msg)
+			continue
+		case c.version >= requestVersion && msg.Type == msgTypeRequest:
+			s.handleRequest(c)
+			continue
+		default:
+			fmt.Printf("[INFO] Ignoring message of type %q\n", msg.Type)
+			continue
+		}
 
-					if textContent != lastClipboardContent {
-						err := clipboard.Write(clipboard.FmtText, []byte(textContent))
-						if err != nil {
-							fmt.Println("[ERROR] Failed to update clipboard text:", err)
-						} else {
-							lastClipboardContent = textContent
-							fmt.Println("Clipboard updated with content:", textContent)
-						}
-					}
-				} else if strings.HasPrefix(content, "image:") {
-					// Handle image content (Base64-encoded)
-					imageContent := strings.TrimPrefix(content, "image:")
-
-					// Decode the Base64-encoded image
-					decodedImage, err := base64.StdEncoding.DecodeString(imageContent)
-					if err != nil {
-						fmt.Printf("[ERROR] Failed to decode image: %v\n", err)
-						sendNotification("Image Error", "Wrong image format received. Must be PNG.")
-						continue
-					}
+		if !s.syncing() {
+			fmt.Println("[INFO] Sync is paused, ignoring clip from", c.displayName())
+			c.sendReceipt(msg.ID, receiptFailed, fmt.Errorf("sync is paused"))
+			continue
+		}
 
-					// Save the image to a file
-					outputFile, err := saveImageToFile(decodedImage)
-					if err != nil {
-						fmt.Printf("[ERROR] Failed to save image to file: %v\n", err)
-						sendNotification("Image Error", "Failed to save image to file. Must be PNG")
-						continue
-					}
-					fmt.Printf("[INFO] Image saved to: %s\n", outputFile)
+		data, err := msg.clipData()
+		if err != nil {
+			fmt.Printf("[ERROR] Failed to decode clip: %v\n", err)
+			c.sendReceipt(msg.ID, receiptFailed, err)
+			continue
+		}
+		if !deviceSettingsFor(c.deviceID).sends(msg.MIME) {
+			fmt.Printf("[INFO] Ignoring %s clip from %s, its settings do not allow it\n", msg.MIME, c.displayName())
+			c.sendReceipt(msg.ID, receiptFailed, fmt.Errorf("this PC does not take %s clips from the device", msg.MIME))
+			continue
+		}
+		c.traffic.clipsReceived.Add(1)
+
+		// Content the PC already has was relayed before, and clips seen
+		// recently are echoes or arrived over another path
+		hash := contentHash(msg.MIME, data)
+		if hash == s.lastSeen() {
+			c.sendReceipt(msg.ID, receiptApplied, nil)
+			continue
+		}
+		if prev, ok := s.echoes.accept(msg.ID, hash, c.echoKey()); !ok {
+			fmt.Printf("[INFO] Ignoring repeated clip from %s, first seen %s ago from %s\n", c.displayName(), time.Since(prev.at).Round(time.Millisecond), prev.origin)
+			status := receiptSuperseded
+			if hash == s.lastSeen() {
+				status = receiptApplied
+			}
+			c.sendReceipt(msg.ID, status, nil)
+			continue
+		}
 
-					// Send a notification
-					sendNotification("Image Received", "Image saved to the Clipboard and Desktop.")
+		switch msg.MIME {
+		case mimeText:
+			fmt.Printf("[INFO] Clipboard received from client: %s\n", data)
+		case mimePNG:
+			fmt.Printf("[INFO] Image received from client (%d bytes)\n", len(data))
+			if _, err := png.DecodeConfig(bytes.NewReader(data)); err != nil {
+				fmt.Printf("[ERROR] Received image is not a PNG: %v\n", err)
+				sendNotification("Image Error", "Failed to save image to file. Must be PNG")
+				c.sendReceipt(msg.ID, receiptFailed, fmt.Errorf("image is not a PNG: %v", err))
+				continue
+			}
+		default:
+			fmt.Printf("[INFO] Ignoring clip with unsupported MIME type %q\n", msg.MIME)
+			c.sendReceipt(msg.ID, receiptFailed, fmt.Errorf("unsupported MIME type %q", msg.MIME))
+			continue
+		}
 
-					// Save the image to the clipboard
-					changed := clipboard.Write(clipboard.FmtImage, decodedImage)
-					if changed == nil {
-						fmt.Println("[ERROR] Failed to write image to clipboard")
-						sendNotification("Image Error", "Failed to copy image to clipboard.")
-						continue
-					}
-					<-changed // Wait for the write operation to complete
-					fmt.Println("[INFO] Image successfully copied to clipboard.")
-				}
+		// Concurrent copies are settled by last-writer-wins, a clip older
+		// than the one the clipboard holds is dropped here and not relayed
+		if msg.Origin == "" {
+			msg.Origin = c.deviceID
+		}
+		applied, err := s.applyRemote(msg, data)
+		switch {
+		case !applied:
+			c.sendReceipt(msg.ID, receiptSuperseded, nil)
+			continue
+		case err != nil:
+			c.sendReceipt(msg.ID, receiptFailed, err)
+		default:
+			c.sendReceipt(msg.ID, receiptApplied, nil)
+		}
+
+		if msg.MIME == mimeText {
+			if err != nil {
+				fmt.Println("[ERROR] Failed to update clipboard text:", err)
+			} else {
+				fmt.Println("Clipboard updated with content:", string(data))
+				recordHistory(mimeText, data, c.deviceID, c.displayName())
+			}
+		} else {
+			// Save the image to a file
+			outputFile, saveErr := saveImageToFile(data)
+			if saveErr != nil {
+				fmt.Printf("[ERROR] Failed to save image to file: %v\n", saveErr)
+			} else {
+				fmt.Printf("[INFO] Image saved to: %s\n", outputFile)
+				sendNotification("Image Received", "Image saved to the Clipboard and "+config.SaveDir)
+			}
+
+			if err != nil {
+				fmt.Println("[ERROR] Failed to write image to clipboard:", err)
+				sendNotification("Image Error", "Failed to copy image to clipboard.")
+			} else {
+				fmt.Println("[INFO] Image successfully copied to clipboard.")
+				recordHistory(mimePNG, data, c.deviceID, c.displayName())
 			}
 		}
-	})
 
-	// Create and start the HTTP server
-	httpServer = &http.Server{Addr: address, Handler: mux}
-	err := httpServer.ListenAndServe()
-	if err != nil && err != http.ErrServerClosed {
-		fmt.Println("[ERROR] WebSocket server error:", err)
+		// Relay the clip to every other device, never back to its sender. It
+		// keeps its clock and origin, so every device settles conflicts alike.
+		s.distribute(msg, hash, c)
 	}
 }
 
-func monitorClipboardChanges() {
-	lastClipboardContent = readClipboard()
-	fmt.Print("[INFO] Initial clipboard content: ", lastClipboardContent, "\n")
-
+// Broadcast local clipboard changes until ctx ends. Content is compared by
+// hash and only encoded into a message once it changed.
+func (s *Server) monitor(ctx context.Context, changes <-chan struct{}) {
+	// Catch anything copied since the initial content was read
+	s.checkClipboard()
 	for {
 		select {
-		case <-stopMonitoring:
-			fmt.Println("[INFO] Clipboard monitoring paused")
+		case <-ctx.Done():
+			fmt.Println("[INFO] Clipboard monitoring stopped")
 			return
-		default:
-			if paused {
-				time.Sleep(1 * time.Second) // Just wait when paused
-				continue
-			}
-
-			currentContent := readClipboard()
-			if currentContent != lastClipboardContent {
-				// fmt.Printf("[INFO] Clipboard updated locally: %s\n", currentContent)
-				broadcastClipboard(currentContent, "local", nil)
-				lastClipboardContent = currentContent
-			}
-			time.Sleep(1 * time.Second)
+		case <-changes:
+			s.checkClipboard()
 		}
 	}
 }
 
-// Broadcast clipboard updates to all connected clients except the source
-func broadcastClipboard(content, source string, sourceConn *websocket.Conn) {
-	// Prevent sending the same content repeatedly
-	if source == "server" && content == lastClipboardContent {
-		fmt.Println("[INFO] Skipping broadcast, same content as last update.")
-		return
+// Broadcast the clipboard content if it changed
+func (s *Server) checkClipboard() {
+	s.clipMu.Lock()
+	defer s.clipMu.Unlock()
+	s.checkClipboardLocked()
+}
+
+// Returns whether the clipboard changed. The caller must hold s.clipMu.
+func (s *Server) checkClipboardLocked() bool {
+	mime, data := s.readClipboard()
+	hash := contentHash(mime, data)
+	if mime == "" || !s.seen(hash) {
+		return false
 	}
+	s.publishLocal(mime, data, hash)
+	recordHistory(mime, data, localDeviceID, "This PC")
+	return true
+}
+
+// Broadcast clipboard updates to all connected clients except the source.
+// Transfers are tracked so devices can resume them, and paired devices that
+// are not connected get the clip in their outbox. Returns the devices the
+// clip was queued for.
+func (s *Server) broadcastClipboard(msg *Message, hash string, sourceConn *websocket.Conn) []recipient {
+	paired := listPairedDevices()
+	settings := make(map[string]deviceSettings, len(paired))
+	for _, d := range paired {
+		settings[d.ID] = d.Settings
+	}
+	enc := newClipEncodings(msg)
+	var delivered []recipient
 
 	clientsMutex.Lock()
 	defer clientsMutex.Unlock()
 
-	for client := range clients {
-		if client == sourceConn {
+	ready := make(map[string]bool) // Devices connected and past their hello
+	for conn, c := range clients {
+		if conn == sourceConn {
+			ready[c.deviceID] = true
 			continue // Skip broadcasting to the source client
 		}
+		if !c.authenticated {
+			continue // Never send clipboard content to unpaired clients
+		}
+		if !c.handshaked && time.Since(c.connectedAt) < handshakeGrace {
+			continue // Give new clients time to say hello before picking a format
+		}
+		ready[c.deviceID] = true
+		if !settings[c.deviceID].receives(msg.MIME) {
+			continue // The user does not want it on this device
+		}
+		if !c.accepts(msg) {
+			fmt.Printf("[INFO] Skipping client that does not accept %s clips of %d bytes\n", msg.MIME, msg.size())
+			continue
+		}
+		if enc.sendTo(c, s.transfers) {
+			delivered = append(delivered, c.recipient())
+		}
+	}
+	fmt.Printf("[INFO] Broadcasted clipboard update to %d clients\n", len(delivered))
 
-		err := client.WriteMessage(websocket.TextMessage, []byte(content))
-		if err != nil {
-			fmt.Printf("[ERROR] Failed to send message to client: %v\n", err)
-			client.Close()
-			delete(clients, client)
+	var offline []recipient
+	for _, d := range paired {
+		if !ready[d.ID] && d.ID != msg.Origin && d.Settings.receives(msg.MIME) {
+			offline = append(offline, recipient{deviceID: d.ID, name: d.displayName(), queued: true})
 		}
 	}
-	fmt.Printf("[INFO] Broadcasted clipboard update to %d clients\n", len(clients))
+	if s.outbox.add(msg, hash, offline) {
+		delivered = append(delivered, offline...)
+	}
+	return delivered
 }
 
-func readClipboard() string {
-	text := clipboard.Read(clipboard.FmtText)
-	if text != nil && len(text) > 0 {
-		return fmt.Sprintf("text:%s", string(text))
-	}
+// Encodings of a clip, built once and shared by the clients it is sent to
+type clipEncodings struct {
+	msg     *Message
+	inline  *Message        // msg with its payload encoded, built on first use
+	encoded map[bool][]byte // By whether the client is legacy
+	shared  *sharedTransfer // Built for the first client that takes a transfer
+}
 
-	// Read image data from the clipboard
-	imageData := clipboard.Read(clipboard.FmtImage)
-	if imageData != nil && len(imageData) > 0 {
-		// Decode the image from the byte slice
-		img, _, err := image.Decode(bytes.NewReader(imageData))
+func newClipEncodings(msg *Message) *clipEncodings {
+	return &clipEncodings{msg: msg, encoded: make(map[bool][]byte)}
+}
+
+// Queue the clip for one client, as a chunked transfer if it is large and the
+// client supports them. Transfers are tracked in store so the client can
+// resume them. The caller must hold clientsMutex.
+func (e *clipEncodings) sendTo(c *client, store *transferStore) bool {
+	if c.version >= transferVersion && e.msg.size() > transferChunkSize {
+		if e.shared == nil {
+			var err error
+			if e.shared, err = newSharedTransfer(e.msg); err != nil {
+				fmt.Printf("[ERROR] Failed to prepare transfer: %v\n", err)
+				return false
+			}
+		}
+		t, err := e.shared.forClient(c, 0)
 		if err != nil {
-			fmt.Println("[ERROR] Failed to decode image:", err)
-			return ""
+			fmt.Printf("[ERROR] Failed to encode message: %v\n", err)
+			return false
 		}
-		// Encode the image as Base64
-		var buf bytes.Buffer
-		err = png.Encode(&buf, img)
+		if !c.enqueueTransfer(t) {
+			return false
+		}
+		store.track(c, e.shared)
+		c.traffic.clipsSent.Add(1)
+		return true
+	}
+
+	// Encrypted clients get their own ciphertext, the rest share encodings
+	if e.inline == nil {
+		e.inline = e.msg.inline()
+	}
+	data, ok := e.encoded[c.legacy]
+	if !ok || c.session != nil {
+		var err error
+		data, err = encodeFor(c, e.inline)
 		if err != nil {
-			fmt.Println("[ERROR] Failed to encode image:", err)
-			return ""
+			fmt.Printf("[ERROR] Failed to encode message: %v\n", err)
+			return false
 		}
-		encodedImage := base64.StdEncoding.EncodeToString(buf.Bytes())
-		return fmt.Sprintf("image:%s", encodedImage)
+		if c.session == nil {
+			e.encoded[c.legacy] = data
+		}
+	}
+	if !c.enqueueClip(data) {
+		return false
 	}
+	c.traffic.clipsSent.Add(1)
+	return true
+}
 
-	return ""
+// Report a device that connected, once it can be named
+func announceClient(c *client) {
+	clientsMutex.Lock()
+	if c.announced || clients[c.conn] != c || !c.authenticated {
+		clientsMutex.Unlock()
+		return
+	}
+	c.announced = true
+	name, names := c.displayName(), connectedNames()
+	clientsMutex.Unlock()
+
+	updateConnectedDevices()
+	fmt.Printf("[INFO] %s connected. Connected devices: %s\n", name, names)
+	sendNotification("Device Connected", name+" connected")
 }
 
-var qrRouteRegistered = false
+// Remove a disconnected client and report the devices still connected
+func removeClient(conn *websocket.Conn) {
+	clientsMutex.Lock()
+	c := clients[conn]
+	delete(clients, conn) // Remove client from the map
+	names := connectedNames()
+	announced := c != nil && c.announced
+	var name string
+	if announced {
+		name = c.displayName()
+	}
+	clientsMutex.Unlock()
 
-func openQRCodePage() {
-	// Register the /qr route only once
-	if !qrRouteRegistered {
-		ip := getLocalIP()
-		wsURL := fmt.Sprintf("ws://%s:8080/ws", ip)
-		qrCode, err := qrcode.Encode(wsURL, qrcode.Medium, 256)
-		if err != nil {
-			fmt.Println("[ERROR] Failed to generate QR code:", err)
-			return
+	// Update the list of connected devices
+	updateConnectedDevices()
+
+	// Only devices whose connection was reported are reported gone
+	if !announced {
+		fmt.Println("[INFO] Client disconnected before it was announced")
+		return
+	}
+	fmt.Printf("[INFO] %s disconnected. Connected devices: %s\n", name, names)
+	sendNotification("Device Disconnected", name+" disconnected")
+}
+
+// Announced devices in the order they connected. The caller must hold
+// clientsMutex.
+func connectedClients() []*client {
+	var connected []*client
+	for _, c := range clients {
+		if c.announced {
+			connected = append(connected, c)
 		}
+	}
+	sort.Slice(connected, func(i, j int) bool { return connected[i].connectedAt.Before(connected[j].connectedAt) })
+	return connected
+}
+
+// Names of the announced devices, for logs and the tray. The caller must hold
+// clientsMutex.
+func connectedNames() string {
+	connected := connectedClients()
+	if len(connected) == 0 {
+		return "none"
+	}
+	names := make([]string, len(connected))
+	for i, c := range connected {
+		names[i] = c.displayName()
+	}
+	return strings.Join(names, ", ")
+}
+
+// Read the current clipboard content as raw bytes, preferring text. Returns
+// an empty MIME type when the clipboard is empty or cannot be read.
+func (s *Server) readClipboard() (string, []byte) {
+	text, err := s.clipboard.ReadText()
+	if err != nil {
+		fmt.Println("[ERROR] Failed to read clipboard:", err)
+		return "", nil
+	}
+	if len(text) > 0 {
+		return mimeText, text
+	}
+
+	imageData, err := s.clipboard.ReadImage()
+	if err != nil {
+		fmt.Println("[ERROR] Failed to read clipboard image:", err)
+		return "", nil
+	}
+	if len(imageData) > 0 {
+		return mimePNG, imageData
+	}
+	return "", nil
+}
+
+var localPagesOnce sync.Once
 
+// URL a device connects to for pairing. Every call issues a fresh one-time
+// pairing token, and devices pin the certificate by the fingerprint in it.
+func pairingURL() string {
+	token, secret := newPairingToken()
+	wsURL := fmt.Sprintf("%s://%s/ws?pair=%s&ks=%s", wsScheme(), net.JoinHostPort(advertisedIP(), strconv.Itoa(config.Port)), token, secret)
+	if !config.Plain {
+		wsURL += "&fp=" + certFingerprint
+	}
+	return wsURL
+}
+
+// Register the local pages and start serving them, only once
+func startLocalPages() {
+	// Register the /qr route only once
+	localPagesOnce.Do(func() {
 		// Register the route for QR page
 		http.HandleFunc("/qr", func(w http.ResponseWriter, r *http.Request) {
+			// Every page load carries a fresh one-time pairing token
+			wsURL := pairingURL()
+			qrCode, err := qrcode.Encode(wsURL, qrcode.Medium, 256)
+			if err != nil {
+				fmt.Println("[ERROR] Failed to generate QR code:", err)
+				http.Error(w, "failed to generate QR code", http.StatusInternalServerError)
+				return
+			}
+
 			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Cache-Control", "no-store")
 			fmt.Fprintf(w, `<!DOCTYPE html>
 				<html lang="en">
 					<head>
@@ -538,11 +878,12 @@ func openQRCodePage() {
 						<p>Sync your clipboard effortlessly</p>
 						</div>
 						<div class="content">
-						<p>Connect your Android device using the WebSocket URL or scan the QR code below:</p>
+						<p>Pair your Android device by scanning the QR code below or entering the WebSocket URL:</p>
 						<p><strong>WebSocket URL:</strong> <code>%s</code></p>
 						<img src="data:image/png;base64,%s" alt="QR Code">
+						<p class="note">The pairing code can be used once and expires in %d minutes. Reload the page for a new one.</p>
 						<p class="note">You can use it using your system tray.</p>
-						<p class="note">The clipboard images will be saved to <code>YOUR_Desktop\clipy</code>. Note: Except .PNG all formats would be ignored. </p>
+						<p class="note">The clipboard images will be saved to <code>%s</code>. Note: Except .PNG all formats would be ignored. </p>
 						</div>
 
 						<!-- Footer with GitHub link -->
@@ -555,37 +896,53 @@ func openQRCodePage() {
 					</body>
 				</html>
 
-			`, wsURL, base64.StdEncoding.EncodeToString(qrCode))
+			`, wsURL, base64.StdEncoding.EncodeToString(qrCode), int(pairingTokenTTL.Minutes()), html.EscapeString(config.SaveDir))
 		})
 
-		// Mark the route as registered
-		qrRouteRegistered = true
-	}
+		// Start the QR server in a new goroutine to serve the page
+		go startQRCodeServer()
+	})
+}
 
-	// Start the QR server in a new goroutine to serve the page
-	go startQRCodeServer()
+func openQRCodePage() {
+	startLocalPages()
 
 	// Open the QR code page in the browser using a unique URL path
 	ip := "localhost"
-	err := exec.Command(getBrowserCommand(), "/c", "start", fmt.Sprintf("http://%s:3000/qr", ip)).Start()
+	err := exec.Command(getBrowserCommand(), "/c", "start", fmt.Sprintf("http://%s:%d/qr", ip, config.QRPort)).Start()
 	if err != nil {
 		fmt.Println("[ERROR] Failed to open QR code page:", err)
 	}
 }
 
-// Start an HTTP server on port 3000 to serve the QR code page
+// Start an HTTP server on the QR port to serve the QR code page
 func startQRCodeServer() {
 	httpServer := &http.Server{
-		Addr:    ":3000", // Listen on port 3000
-		Handler: nil,     // Use default mux
+		Addr:    fmt.Sprintf("127.0.0.1:%d", config.QRPort), // Local only, the page hands out pairing tokens
+		Handler: localOnly(http.DefaultServeMux),
 	}
 
-	fmt.Println("[INFO] Starting HTTP server on http://localhost:3000")
+	fmt.Printf("[INFO] Starting HTTP server on http://localhost:%d\n", config.QRPort)
 	if err := httpServer.ListenAndServe(); err != nil {
 		fmt.Println("[ERROR] HTTP server error:", err)
 	}
 }
 
+// Refuse requests that do not name this machine in their Host header.
+// Otherwise a web page could use DNS rebinding to become same-origin with the
+// local pages, then read the history or take a pairing token.
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		port := strconv.Itoa(config.QRPort)
+		if r.Host != "localhost:"+port && r.Host != "127.0.0.1:"+port {
+			fmt.Printf("[WARN] Refused local page request for host %q\n", r.Host)
+			http.Error(w, "forbidden host", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Utility to get the default browser command based on OS
 func getBrowserCommand() string {
 	switch runtime.GOOS {
@@ -598,6 +955,15 @@ func getBrowserCommand() string {
 	}
 }
 
+// Address devices should connect to: the bind address if it is a specific
+// one, otherwise the detected Wi-Fi address
+func advertisedIP() string {
+	if ip := net.ParseIP(config.BindAddress); ip != nil && !ip.IsUnspecified() {
+		return config.BindAddress
+	}
+	return getLocalIP()
+}
+
 // Utility to get local IP address (WLAN adapter)
 func getLocalIP() string {
 	interfaces, err := net.Interfaces()
@@ -631,84 +997,32 @@ func getLocalIP() string {
 	return "127.0.0.1"
 }
 
-// Utility to get tray icon (reads icon file and returns it as byte slice)
-func getIcon() []byte {
-	// Load the icon from a file (ensure the path to the icon is correct)
-	iconPath := "clipylogo.ico" // Replace with your actual file path
-
-	iconFile, err := os.Open(iconPath)
-	if err != nil {
-		fmt.Println("[ERROR] Failed to load icon:", err)
-		return nil
-	}
-	defer iconFile.Close()
-
-	// Read the icon file into a byte slice
-	iconBytes, err := io.ReadAll(iconFile)
-	if err != nil {
-		fmt.Println("[ERROR] Failed to read icon:", err)
-		return nil
-	}
-
-	return iconBytes
-}
-
-// Send a notification if notifications are enabled
+// Send a notification if notifications are enabled. Headless mode has no
+// desktop to notify, so notifications only go to the log.
 func sendNotification(title, message string) {
-	if notificationsEnabled {
-		err := beeep.Notify(title, message, "clipylogo.png")
-		if err != nil {
-			fmt.Printf("[ERROR] Unable to send notification: %v\n", err)
-		}
+	if !notificationsEnabled.Load() {
+		return
 	}
-}
-
-// Function to toggle notifications on or off
-func toggleNotifications() {
-	if notificationsEnabled {
-		notificationsEnabled = false
-		notificationsMenuItem.SetTitle("Enable Notifications")
-		sendNotification("Notifications Disabled", "Notifications have been turned off.")
-	} else {
-		notificationsEnabled = true
-		notificationsMenuItem.SetTitle("Disable Notifications")
-		sendNotification("Notifications Enabled", "Notifications have been turned on.")
+	if config.Headless {
+		fmt.Printf("[NOTIFY] %s: %s\n", title, message)
+		return
 	}
+	notify(title, message)
 }
 
 // Cleanup on exit
 func onExit() {
-	// Stop clipboard monitoring by sending stop signal
-	stopMonitoring <- true
-
-	// Close WebSocket connections (close each client connection)
-	clientsMutex.Lock()
-	for client := range clients {
-		err := client.Close()
-		if err != nil {
-			fmt.Printf("[ERROR] Failed to close client connection: %v\n", err)
-		} else {
-			fmt.Println("[INFO] Client connection closed.")
+	if server.State() != stateStopped {
+		if err := server.Stop(); err != nil {
+			fmt.Println("[ERROR] Failed to stop server:", err)
 		}
 	}
-	clientsMutex.Unlock()
-
-	// Close the HTTP server (shuts down WebSocket server as well)
-	if httpServer != nil {
-		err := httpServer.Close()
-		if err != nil {
-			fmt.Printf("[ERROR] Failed to close HTTP server: %v\n", err)
-		} else {
-			fmt.Println("[INFO] HTTP server stopped successfully.")
-		}
-	}
-
 	fmt.Println("[INFO] Server stopped successfully.")
 
 	os.Exit(0)
 }
 
-// Saves the image to the Desktop inside the "clipy" folder and returns the file path
+// Saves the image to the configured save folder and returns the file path
 func saveImageToFile(decodedImage []byte) (string, error) {
 	// Create a file from the decoded image
 	imgReader := bytes.NewReader(decodedImage)
@@ -717,18 +1031,11 @@ func saveImageToFile(decodedImage []byte) (string, error) {
 		return "", fmt.Errorf("failed to decode image from bytes: %v", err)
 	}
 
-	// Get the desktop directory
-	desktopDir, err := os.UserHomeDir()
-	if err != nil {
-		return "", fmt.Errorf("unable to get user home directory: %v", err)
-	}
-	desktopDir = filepath.Join(desktopDir, "Desktop")
-
-	// Create the "clipy" folder on the desktop if it doesn't exist
-	clipyFolder := filepath.Join(desktopDir, "clipy")
+	// Create the save folder, Desktop/clipy by default, if it doesn't exist
+	clipyFolder := config.SaveDir
 	err = os.MkdirAll(clipyFolder, os.ModePerm)
 	if err != nil {
-		return "", fmt.Errorf("failed to create 'clipy' folder: %v", err)
+		return "", fmt.Errorf("failed to create save folder: %v", err)
 	}
 
 	// Create a unique filename for the image in the format "DD-MM-YY_HHMMSS_clipboard_image.png"
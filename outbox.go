@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// What a paired device that was not connected gets when it comes back
+const (
+	offlineLatest = "latest" // Only the newest clip it missed
+	offlineAll    = "all"    // Every clip it missed, oldest first
+	offlineNone   = "none"   // Nothing, missed clips are lost
+)
+
+var offlineDeliveryModes = []string{offlineLatest, offlineAll, offlineNone}
+
+// A clip waiting for a device to reconnect
+type outboxItem struct {
+	msg      *Message
+	hash     string
+	queuedAt time.Time
+}
+
+// Clips missed by paired devices while they were not connected, by device.
+// Each queue is bounded by config.OutboxLimit, config.OutboxMaxAge and
+// config.OutboxMaxBytes, dropping the oldest clips first.
+type outbox struct {
+	mu     sync.Mutex
+	queues map[string][]*outboxItem // Oldest first
+}
+
+func newOutbox() *outbox {
+	return &outbox{queues: make(map[string][]*outboxItem)}
+}
+
+// Queue a clip for devices that are not connected. Returns false if it was
+// not queued.
+func (o *outbox) add(msg *Message, hash string, devices []recipient) bool {
+	if len(devices) == 0 || config.OfflineDelivery == offlineNone {
+		return false
+	}
+	if msg.size() > config.OutboxMaxBytes {
+		fmt.Printf("[INFO] Not keeping clip of %d bytes for offline devices, the outbox holds %d\n", msg.size(), config.OutboxMaxBytes)
+		return false
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	item := &outboxItem{msg: msg, hash: hash, queuedAt: now}
+	for _, d := range devices {
+		if config.OfflineDelivery == offlineLatest {
+			o.queues[d.deviceID] = []*outboxItem{item}
+			continue
+		}
+		o.queues[d.deviceID] = trimOutbox(append(o.queues[d.deviceID], item), now)
+	}
+	fmt.Printf("[INFO] Kept clip for %d offline devices\n", len(devices))
+	return true
+}
+
+// Drop the oldest clips of a queue until it is within the limits
+func trimOutbox(queue []*outboxItem, now time.Time) []*outboxItem {
+	var size int64
+	for _, item := range queue {
+		size += item.msg.size()
+	}
+	for len(queue) > 0 {
+		oldest := queue[0]
+		if len(queue) <= config.OutboxLimit && size <= config.OutboxMaxBytes && now.Sub(oldest.queuedAt) <= time.Duration(config.OutboxMaxAge) {
+			break
+		}
+		size -= oldest.msg.size()
+		queue = queue[1:]
+	}
+	return queue
+}
+
+// Remove and return the clips kept for a device, oldest first
+func (o *outbox) take(device string) []*outboxItem {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	queue := trimOutbox(o.queues[device], time.Now())
+	delete(o.queues, device)
+	return queue
+}
+
+// Send a device that just said hello, or started being treated as a legacy
+// client, the clips it missed while away. Returns the IDs of the clips sent.
+func (s *Server) flushOutbox(c *client) []string {
+	if !s.syncing() {
+		return nil
+	}
+
+	// The hello may be completing at the same time
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	if c.deviceID == "" {
+		return nil
+	}
+	items := s.outbox.take(c.deviceID)
+	if len(items) == 0 {
+		return nil
+	}
+
+	settings := deviceSettingsFor(c.deviceID)
+	var sent []string
+	for _, item := range items {
+		if !c.accepts(item.msg) || !settings.receives(item.msg.MIME) {
+			continue
+		}
+		if newClipEncodings(item.msg).sendTo(c, s.transfers) {
+			s.echoes.delivered(item.hash, []string{c.echoKey()})
+			sent = append(sent, item.msg.ID)
+		}
+	}
+	fmt.Printf("[INFO] Sent %s %d clips it missed while away\n", c.displayName(), len(sent))
+	return sent
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a pairing token shown in the QR code stays valid
+	pairingTokenTTL = 5 * time.Minute
+
+	pairedDevicesFile = "devices.json"
+)
+
+// A device that exchanged a pairing token for a long-lived credential, and
+// what is known about it
+type pairedDevice struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"` // Reported by the device at pairing, the user may change it
+	Platform string    `json:"platform"`
+	KeyHash  string    `json:"keyHash"`          // SHA-256 of the device key, the key itself is never stored
+	EncKey   []byte    `json:"encKey,omitempty"` // End-to-end encryption key agreed at pairing
+	PairedAt time.Time `json:"pairedAt"`         // Also when it was first seen
+	LastSeen time.Time `json:"lastSeen,omitempty"`
+
+	Stats    deviceStats    `json:"stats"`
+	Settings deviceSettings `json:"settings"`
+}
+
+// On-disk state of the pairing store
+type deviceStore struct {
+	ServerID string          `json:"serverId"`
+	Devices  []*pairedDevice `json:"devices"`
+}
+
+var (
+	pairing            deviceStore
+	pairingMutex       sync.Mutex
+	pairingToken       string    // Current one-time token, empty once used
+	pairingSecret      string    // Shown in the QR code next to the token, never sent back
+	pairingTokenExpiry time.Time // When pairingToken stops being accepted
+)
+
+// Directory holding Clipy's persistent state
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to get user config directory: %v", err)
+	}
+	dir = filepath.Join(dir, "clipy")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create config directory: %v", err)
+	}
+	return dir, nil
+}
+
+// Load the paired devices and the server identity from disk, creating the
+// store on first run
+func loadPairedDevices() error {
+	pairingMutex.Lock()
+	defer pairingMutex.Unlock()
+
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, pairedDevicesFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read paired devices: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &pairing); err != nil {
+			return fmt.Errorf("failed to parse paired devices: %v", err)
+		}
+	}
+
+	if pairing.ServerID == "" {
+		pairing.ServerID = newMessageID()
+		if err := savePairedDevices(); err != nil {
+			return err
+		}
+	}
+	localDeviceID = pairing.ServerID
+
+	fmt.Printf("[INFO] Loaded %d paired devices\n", len(pairing.Devices))
+	return nil
+}
+
+// Write the pairing store to disk. The caller must hold pairingMutex.
+func savePairedDevices() error {
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(&pairing, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode paired devices: %v", err)
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, pairedDevicesFile), data); err != nil {
+		return fmt.Errorf("failed to write paired devices: %v", err)
+	}
+	return nil
+}
+
+// Write a private file through a temporary file so a crash never leaves it
+// truncated
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Generate a random secret encoded for use in URLs
+func newSecret(size int) string {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Issue a fresh one-time pairing token, invalidating any previous one.
+// Returns the token and the pairing secret that authenticates the key
+// exchange, both shown in the QR code.
+func newPairingToken() (string, string) {
+	pairingMutex.Lock()
+	defer pairingMutex.Unlock()
+
+	pairingToken = newSecret(16)
+	pairingSecret = newSecret(16)
+	pairingTokenExpiry = time.Now().Add(pairingTokenTTL)
+	return pairingToken, pairingSecret
+}
+
+// Check a pairing token and burn it so it cannot be used twice. Returns the
+// pairing secret issued with it.
+func consumePairingToken(token string) (string, bool) {
+	pairingMutex.Lock()
+	defer pairingMutex.Unlock()
+
+	if pairingToken == "" || time.Now().After(pairingTokenExpiry) {
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(pairingToken)) != 1 {
+		return "", false
+	}
+	secret := pairingSecret
+	pairingToken, pairingSecret = "", ""
+	return secret, true
+}
+
+// Create a paired device and return its ID and secret key. encKey is nil
+// for devices that do not support end-to-end encryption.
+func pairDevice(name, platform string, encKey []byte) (string, string, error) {
+	id := newMessageID()
+	key := newSecret(32)
+
+	pairingMutex.Lock()
+	defer pairingMutex.Unlock()
+
+	pairing.Devices = append(pairing.Devices, &pairedDevice{
+		ID:       id,
+		Name:     name,
+		Platform: platform,
+		KeyHash:  hashDeviceKey(key),
+		EncKey:   encKey,
+		PairedAt: time.Now(),
+		LastSeen: time.Now(),
+	})
+	if err := savePairedDevices(); err != nil {
+		pairing.Devices = pairing.Devices[:len(pairing.Devices)-1]
+		return "", "", err
+	}
+
+	fmt.Printf("[INFO] Paired new device %s (%s)\n", name, id)
+	return id, key, nil
+}
+
+// Return a copy of the paired device matching the credential, or nil. The
+// store keeps changing after the lock is released, so callers never get the
+// device itself.
+func authenticateDevice(id, key string) *pairedDevice {
+	pairingMutex.Lock()
+	defer pairingMutex.Unlock()
+
+	hash := hashDeviceKey(key)
+	for _, d := range pairing.Devices {
+		if d.ID == id && subtle.ConstantTimeCompare([]byte(hash), []byte(d.KeyHash)) == 1 {
+			found := *d
+			return &found
+		}
+	}
+	return nil
+}
+
+// Copies of all paired devices
+func listPairedDevices() []pairedDevice {
+	pairingMutex.Lock()
+	defer pairingMutex.Unlock()
+
+	devices := make([]pairedDevice, len(pairing.Devices))
+	for i, d := range pairing.Devices {
+		devices[i] = *d
+	}
+	return devices
+}
+
+// Name shown for the device in logs and notifications
+func (d *pairedDevice) displayName() string {
+	if d.Name != "" {
+		return d.Name
+	}
+	return "Android device"
+}
+
+// Whether the device agreed an encryption key at pairing, in which case
+// clips may only reach it through an encrypted session
+func deviceEncrypted(id string) bool {
+	pairingMutex.Lock()
+	defer pairingMutex.Unlock()
+
+	for _, d := range pairing.Devices {
+		if d.ID == id {
+			return d.EncKey != nil
+		}
+	}
+	return false
+}
+
+func hashDeviceKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPairingTokenIsUsedOnce(t *testing.T) {
+	newTestServer(t)
+
+	token, secret := newPairingToken()
+	if _, ok := consumePairingToken("wrong"); ok {
+		t.Fatal("wrong token accepted")
+	}
+	got, ok := consumePairingToken(token)
+	if !ok || got != secret {
+		t.Fatalf("token refused or wrong secret %q", got)
+	}
+	if _, ok := consumePairingToken(token); ok {
+		t.Fatal("token accepted twice")
+	}
+	if _, ok := consumePairingToken(""); ok {
+		t.Fatal("empty token accepted once the token was used")
+	}
+
+	// A new QR code replaces the previous token
+	old, _ := newPairingToken()
+	current, _ := newPairingToken()
+	if _, ok := consumePairingToken(old); ok {
+		t.Fatal("replaced token accepted")
+	}
+	if _, ok := consumePairingToken(current); !ok {
+		t.Fatal("current token refused")
+	}
+
+	expired, _ := newPairingToken()
+	pairingMutex.Lock()
+	pairingTokenExpiry = time.Now().Add(-time.Second)
+	pairingMutex.Unlock()
+	if _, ok := consumePairingToken(expired); ok {
+		t.Fatal("expired token accepted")
+	}
+}
+
+func TestPairedDevicesPersist(t *testing.T) {
+	newTestServer(t)
+	serverID := localDeviceID
+
+	id, key, err := pairDevice("Phone", "android", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainID, _, err := pairDevice("Tablet", "android", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload from disk as after a restart
+	pairingMutex.Lock()
+	pairing = deviceStore{}
+	pairingMutex.Unlock()
+	if err := loadPairedDevices(); err != nil {
+		t.Fatal(err)
+	}
+	if localDeviceID != serverID {
+		t.Fatal("server identity changed after a restart")
+	}
+
+	d := authenticateDevice(id, key)
+	if d == nil || d.Name != "Phone" || d.Platform != "android" {
+		t.Fatalf("paired device not found after a restart: %+v", d)
+	}
+	if d.KeyHash == key {
+		t.Fatal("device key stored in the clear")
+	}
+	if authenticateDevice(id, "wrong key") != nil || authenticateDevice("unknown", key) != nil {
+		t.Fatal("wrong credential accepted")
+	}
+	if !deviceEncrypted(id) || deviceEncrypted(plainID) {
+		t.Fatal("encryption key not kept with the device")
+	}
+
+	// What the caller got is its own copy
+	d.Name = "Changed"
+	if again := authenticateDevice(id, key); again.Name != "Phone" {
+		t.Fatalf("changing the result renamed the paired device to %q", again.Name)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Range of JSON message envelope versions spoken by this server
+const (
+	minProtocolVersion = 1
+	protocolVersion    = 4
+)
+
+// First version that sends large clips as chunked binary transfers
+const transferVersion = 2
+
+// First version whose clients send and receive receipts for clips
+const receiptVersion = 3
+
+// First version whose clients answer and send requests for the current clip
+const requestVersion = 4
+
+// Message types carried in the envelope
+const (
+	msgTypeClip     = "clip"
+	msgTypeHello    = "hello"
+	msgTypeWelcome  = "welcome"
+	msgTypeError    = "error"
+	msgTypeOffer    = "offer"    // Starts a chunked transfer of a clip
+	msgTypeComplete = "complete" // Ends a chunked transfer with its checksum
+	msgTypeAbort    = "abort"    // Cancels a chunked transfer, from either side
+	msgTypeAck      = "ack"      // Reports how much of a transfer was received
+	msgTypeReceipt  = "receipt"  // Reports what became of a clip on a device
+	msgTypeRequest  = "request"  // Asks the other side for its current clip
+)
+
+// MIME types for clipboard payloads
+const (
+	mimeText = "text/plain"
+	mimePNG  = "image/png"
+)
+
+// Prefixes used by the legacy string protocol of older Android builds
+const (
+	legacyTextPrefix  = "text:"
+	legacyImagePrefix = "image:"
+)
+
+// Message is the versioned envelope exchanged over the WebSocket
+type Message struct {
+	Version   int             `json:"v"`
+	Type      string          `json:"type"`
+	ID        string          `json:"id"`
+	Origin    string          `json:"origin,omitempty"`
+	CreatedAt int64           `json:"createdAt"` // Unix milliseconds
+	MIME      string          `json:"mime,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Clock     *Timestamp      `json:"hlc,omitempty"` // Hybrid logical clock of a clip, for last-writer-wins
+
+	// Set when the payload is end-to-end encrypted
+	Enc   string `json:"enc,omitempty"`
+	Seq   uint64 `json:"seq,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+
+	// Clip content when the payload is not encoded yet, see inline
+	data []byte
+}
+
+// Identifier of this server, used as the origin of locally copied clips
+var localDeviceID = newMessageID()
+
+// Generate a random identifier for messages and devices
+func newMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// Fall back to the clock, an ID only has to be unique, not secret
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Build a clip message for the given content. Clips too large to send
+// inline keep the raw content and are only encoded for clients that need it.
+func newClipMessage(mime string, data []byte, origin string) *Message {
+	msg := &Message{
+		Version:   protocolVersion,
+		Type:      msgTypeClip,
+		ID:        newMessageID(),
+		Origin:    origin,
+		CreatedAt: time.Now().UnixMilli(),
+		MIME:      mime,
+		data:      data,
+	}
+	if len(data) <= transferChunkSize {
+		msg.Payload = encodeClipPayload(mime, data)
+	}
+	return msg
+}
+
+// Text is carried as-is, every other MIME type is base64-encoded inside the
+// JSON string payload
+func encodeClipPayload(mime string, data []byte) json.RawMessage {
+	var payload string
+	if mime == mimeText {
+		payload = string(data)
+	} else {
+		payload = base64.StdEncoding.EncodeToString(data)
+	}
+	raw, _ := json.Marshal(payload)
+	return raw
+}
+
+// The message with its payload encoded, for clients that take clips inline
+func (m *Message) inline() *Message {
+	if m.Payload != nil || m.data == nil {
+		return m
+	}
+	encoded := *m
+	encoded.Payload = encodeClipPayload(m.MIME, m.data)
+	return &encoded
+}
+
+// Size of a clip's content, or of its encoded payload if the content is not
+// at hand
+func (m *Message) size() int64 {
+	if m.data != nil {
+		return int64(len(m.data))
+	}
+	return int64(len(m.Payload))
+}
+
+// Build a control message carrying a JSON-encoded payload
+func newControlMessage(msgType string, payload interface{}) *Message {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to encode %s payload: %v\n", msgType, err)
+	}
+
+	return &Message{
+		Version:   protocolVersion,
+		Type:      msgType,
+		ID:        newMessageID(),
+		Origin:    localDeviceID,
+		CreatedAt: time.Now().UnixMilli(),
+		Payload:   raw,
+	}
+}
+
+// Return the decoded content of a clip message
+func (m *Message) clipData() ([]byte, error) {
+	if m.data != nil {
+		return m.data, nil
+	}
+	var payload string
+	if err := json.Unmarshal(m.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("invalid clip payload: %v", err)
+	}
+	if m.MIME == mimeText {
+		return []byte(payload), nil
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 payload: %v", err)
+	}
+	return data, nil
+}
+
+// Decode a frame received from a client. Both the JSON envelope and the
+// legacy "text:"/"image:" prefix format are accepted; legacy reports which
+// one the client used so replies can be sent in the same format.
+func decodeMessage(raw []byte) (msg *Message, legacy bool, err error) {
+	content := string(raw)
+
+	switch {
+	case strings.HasPrefix(content, legacyTextPrefix):
+		msg, err = parseLegacy(content)
+		return msg, true, err
+	case strings.HasPrefix(content, legacyImagePrefix):
+		msg, err = parseLegacy(content)
+		return msg, true, err
+	}
+
+	msg = &Message{}
+	if err := json.Unmarshal(raw, msg); err != nil {
+		return nil, false, fmt.Errorf("unrecognized message format: %v", err)
+	}
+	if msg.Type == "" {
+		return nil, false, fmt.Errorf("message has no type")
+	}
+	return msg, false, nil
+}
+
+// Encode a message for a client, using the legacy prefix format if requested.
+// Messages that have no legacy representation return an error.
+func encodeMessage(msg *Message, legacy bool) ([]byte, error) {
+	msg = msg.inline()
+	if !legacy {
+		return json.Marshal(msg)
+	}
+
+	if msg.Type != msgTypeClip {
+		return nil, fmt.Errorf("message type %q has no legacy encoding", msg.Type)
+	}
+	var payload string
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("invalid clip payload: %v", err)
+	}
+	switch msg.MIME {
+	case mimeText:
+		return []byte(legacyTextPrefix + payload), nil
+	case mimePNG:
+		return []byte(legacyImagePrefix + payload), nil
+	default:
+		return nil, fmt.Errorf("MIME type %q has no legacy encoding", msg.MIME)
+	}
+}
+
+// Convert a legacy "text:"/"image:" string into a clip message
+func parseLegacy(content string) (*Message, error) {
+	if strings.HasPrefix(content, legacyTextPrefix) {
+		return newClipMessage(mimeText, []byte(strings.TrimPrefix(content, legacyTextPrefix)), ""), nil
+	}
+	if strings.HasPrefix(content, legacyImagePrefix) {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(content, legacyImagePrefix))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image: %v", err)
+		}
+		return newClipMessage(mimePNG, data, ""), nil
+	}
+	return nil, fmt.Errorf("unknown legacy prefix")
+}
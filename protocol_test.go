@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		mime string
+		data []byte
+	}{
+		{mimeText, []byte("hello \"world\"\n")},
+		{mimePNG, []byte{0x89, 'P', 'N', 'G', 0, 1, 2}},
+	}
+	for _, tt := range tests {
+		msg := newClipMessage(tt.mime, tt.data, "phone")
+		raw, err := encodeMessage(msg, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, legacy, err := decodeMessage(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if legacy {
+			t.Fatal("envelope decoded as legacy")
+		}
+		if decoded.Version != protocolVersion || decoded.Type != msgTypeClip || decoded.ID != msg.ID ||
+			decoded.Origin != "phone" || decoded.CreatedAt != msg.CreatedAt || decoded.MIME != tt.mime {
+			t.Fatalf("envelope changed: %+v, sent %+v", decoded, msg)
+		}
+		if data, err := decoded.clipData(); err != nil || !bytes.Equal(data, tt.data) {
+			t.Fatalf("%s payload decoded to %q, %v", tt.mime, data, err)
+		}
+	}
+}
+
+func TestLargeClipsEncodeOnDemand(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), transferChunkSize+1)
+	msg := newClipMessage(mimeText, data, "")
+	if msg.Payload != nil {
+		t.Fatal("large clip encoded up front")
+	}
+	if msg.size() != int64(len(data)) {
+		t.Fatalf("size %d, want %d", msg.size(), len(data))
+	}
+	raw, err := encodeMessage(msg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := decodeMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := decoded.clipData(); !bytes.Equal(got, data) {
+		t.Fatal("large clip changed on the way")
+	}
+}
+
+func TestLegacyFormat(t *testing.T) {
+	msg, legacy, err := decodeMessage([]byte(legacyTextPrefix + "from an old phone"))
+	if err != nil || !legacy {
+		t.Fatalf("legacy text not recognized: %v", err)
+	}
+	if data, _ := msg.clipData(); msg.MIME != mimeText || string(data) != "from an old phone" {
+		t.Fatalf("decoded %s %q", msg.MIME, data)
+	}
+
+	png := []byte{0x89, 'P', 'N', 'G'}
+	raw, err := encodeMessage(newClipMessage(mimePNG, png, ""), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(raw), legacyImagePrefix) {
+		t.Fatalf("legacy image encoded as %q", raw)
+	}
+	msg, legacy, err = decodeMessage(raw)
+	if err != nil || !legacy {
+		t.Fatalf("legacy image not recognized: %v", err)
+	}
+	if data, _ := msg.clipData(); msg.MIME != mimePNG || !bytes.Equal(data, png) {
+		t.Fatalf("decoded %s %v", msg.MIME, data)
+	}
+
+	if _, _, err := decodeMessage([]byte(legacyImagePrefix + "not base64!")); err == nil {
+		t.Fatal("invalid legacy image accepted")
+	}
+
+	// Control messages and other content types have no legacy form
+	if _, err := encodeMessage(newControlMessage(msgTypeWelcome, Welcome{}), true); err == nil {
+		t.Fatal("welcome encoded in the legacy format")
+	}
+	if _, err := encodeMessage(newClipMessage("text/html", []byte("<b>"), ""), true); err == nil {
+		t.Fatal("HTML encoded in the legacy format")
+	}
+}
+
+func TestDecodeRejectsUnknownFrames(t *testing.T) {
+	for _, raw := range []string{"plain text", "{}", `{"v":1,"payload":"x"}`, "[1,2]"} {
+		if _, _, err := decodeMessage([]byte(raw)); err == nil {
+			t.Errorf("%q decoded", raw)
+		}
+	}
+}
+
+func TestControlMessagePayload(t *testing.T) {
+	msg := newControlMessage(msgTypeError, ErrorPayload{Code: errCodeBadHello, Reason: "no"})
+	if msg.Origin != localDeviceID || msg.Version != protocolVersion || msg.ID == "" {
+		t.Fatalf("control message envelope %+v", msg)
+	}
+	var payload ErrorPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil || payload.Code != errCodeBadHello {
+		t.Fatalf("payload %s, %v", msg.Payload, err)
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Lifecycle of the sync server
+type serverState int
+
+const (
+	stateStopped serverState = iota
+	stateStarting
+	stateRunning
+	statePaused // Connections stay open but no clips are exchanged
+	stateStopping
+)
+
+func (s serverState) String() string {
+	switch s {
+	case stateStopped:
+		return "stopped"
+	case stateStarting:
+		return "starting"
+	case stateRunning:
+		return "running"
+	case statePaused:
+		return "paused"
+	case stateStopping:
+		return "stopping"
+	default:
+		return "unknown"
+	}
+}
+
+// How long Stop waits for devices to disconnect before closing them forcibly
+const stopTimeout = 5 * time.Second
+
+// Close reason sent to devices when the server stops
+const stopReason = "server stopped"
+
+// Server runs the WebSocket server and the clipboard monitor. All state
+// changes go through its methods, which are safe to call from any goroutine.
+type Server struct {
+	clipboard Clipboard
+
+	mu            sync.Mutex
+	state         serverState
+	addr          net.Addr        // Listening address while running
+	ctx           context.Context // Ends with the current run
+	cancel        context.CancelFunc
+	httpServer    *http.Server
+	done          chan struct{}      // Closed once the WebSocket server has exited
+	monitorCancel context.CancelFunc // Ends the clipboard monitor, nil while paused
+	monitorDone   chan struct{}
+	lastHash      string // Content hash of what the clipboard was last seen or set to
+
+	handlers sync.WaitGroup // Running WebSocket handlers, including hijacked ones
+
+	// Held while writing the clipboard or checking it for changes, so the
+	// monitor never sees a remote clip before its hash is recorded
+	clipMu    sync.Mutex
+	current   clipVersion // Version of the clip the clipboard holds, guarded by clipMu
+	currentID string      // Message ID of that clip, guarded by clipMu
+
+	echoes     *echoCache       // Recent clips, for loop suppression
+	clock      *hybridClock     // Stamps clips for last-writer-wins
+	transfers  *transferStore   // Interrupted transfers devices may resume
+	deliveries *deliveryTracker // Clips waiting for receipts
+	outbox     *outbox          // Clips for paired devices that are away
+}
+
+// The server started by the tray or headless mode
+var server *Server
+
+func newServer(cb Clipboard) *Server {
+	return &Server{
+		clipboard:  cb,
+		echoes:     newEchoCache(),
+		clock:      newHybridClock(),
+		transfers:  newTransferStore(),
+		deliveries: newDeliveryTracker(),
+		outbox:     newOutbox(),
+	}
+}
+
+// Current state of the server
+func (s *Server) State() serverState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Address the server listens on, nil unless it is running or paused
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
+// Start listening for devices and watching the clipboard. The port is bound
+// before Start returns, so a busy port is reported as an error.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	if s.state != stateStopped {
+		state := s.state
+		s.mu.Unlock()
+		return fmt.Errorf("cannot start, server is %s", state)
+	}
+	s.state = stateStarting
+	s.mu.Unlock()
+
+	ln, err := s.listen()
+	if err != nil {
+		s.setState(stateStopped)
+		return err
+	}
+	hash := s.initialHash()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.handleWebSocket)
+	srv := &http.Server{
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.serve(srv, ln)
+	}()
+
+	s.mu.Lock()
+	s.state = stateRunning
+	s.addr = ln.Addr()
+	s.ctx, s.cancel = ctx, cancel
+	s.httpServer = srv
+	s.done = done
+	s.startMonitor(hash)
+	s.mu.Unlock()
+
+	fmt.Printf("[INFO] Starting WebSocket server on %s://%s/ws\n", wsScheme(), ln.Addr())
+	return nil
+}
+
+// Bind the configured address, or the detected Wi-Fi address
+func (s *Server) listen() (net.Listener, error) {
+	ip := config.BindAddress
+	if ip == "" {
+		ip = getLocalIP()
+	}
+	if ip == "" {
+		return nil, fmt.Errorf("could not determine local IP address")
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(config.Port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+	return ln, nil
+}
+
+func (s *Server) serve(srv *http.Server, ln net.Listener) {
+	var err error
+	if config.Plain {
+		err = srv.Serve(ln)
+	} else {
+		srv.TLSConfig = serverTLSConfig()
+		err = srv.ServeTLS(ln, "", "")
+	}
+	if err != nil && err != http.ErrServerClosed {
+		fmt.Println("[ERROR] WebSocket server error:", err)
+	}
+}
+
+// Stop exchanging clips. Devices stay connected.
+func (s *Server) Pause() error {
+	s.mu.Lock()
+	if s.state != stateRunning {
+		state := s.state
+		s.mu.Unlock()
+		return fmt.Errorf("cannot pause, server is %s", state)
+	}
+	s.state = statePaused
+	done := s.stopMonitor()
+	s.mu.Unlock()
+
+	<-done
+	return nil
+}
+
+// Exchange clips again after a pause. What was copied while paused is not
+// sent, the monitor starts from the current clipboard content.
+func (s *Server) Resume() error {
+	hash := s.initialHash()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != statePaused {
+		return fmt.Errorf("cannot resume, server is %s", s.state)
+	}
+	s.state = stateRunning
+	s.startMonitor(hash)
+	return nil
+}
+
+// Stop the server: stop accepting connections, send every device a close
+// frame and wait for them to disconnect, freeing the port. Devices that do
+// not go away within stopTimeout are disconnected forcibly.
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	if s.state != stateRunning && s.state != statePaused {
+		state := s.state
+		s.mu.Unlock()
+		return fmt.Errorf("cannot stop, server is %s", state)
+	}
+	s.state = stateStopping
+	monitorDone := s.stopMonitor()
+	s.cancel()
+	srv, done := s.httpServer, s.done
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+
+	// Closes the listener and waits for connections still being upgraded
+	var err error
+	if shutdownErr := srv.Shutdown(ctx); shutdownErr != nil {
+		err = fmt.Errorf("failed to shut down HTTP server: %v", shutdownErr)
+		srv.Close()
+	}
+
+	// Hijacked WebSocket connections outlive the HTTP server, close them
+	// with a reason and let their writers flush
+	clientsMutex.Lock()
+	for _, c := range clients {
+		c.enqueueClose(websocket.CloseGoingAway, stopReason)
+		c.shutdown()
+	}
+	clientsMutex.Unlock()
+
+	handlersDone := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(handlersDone)
+	}()
+	select {
+	case <-handlersDone:
+	case <-ctx.Done():
+		fmt.Println("[WARN] Devices did not disconnect in time, closing their connections")
+		clientsMutex.Lock()
+		for _, c := range clients {
+			c.disconnect()
+		}
+		clientsMutex.Unlock()
+		<-handlersDone
+	}
+	<-done
+	<-monitorDone
+	s.transfers.clear()
+	s.deliveries.clear()
+
+	s.mu.Lock()
+	s.state = stateStopped
+	s.addr, s.ctx, s.cancel, s.httpServer, s.done = nil, nil, nil, nil, nil
+	s.mu.Unlock()
+	return err
+}
+
+func (s *Server) setState(state serverState) {
+	s.mu.Lock()
+	s.state = state
+	s.mu.Unlock()
+}
+
+// Hash of the clipboard content the monitor starts from
+func (s *Server) initialHash() string {
+	mime, data := s.readClipboard()
+	fmt.Printf("[INFO] Initial clipboard content: %s (%d bytes)\n", mime, len(data))
+	return contentHash(mime, data)
+}
+
+// Start the clipboard monitor for the current run. The caller must hold s.mu.
+func (s *Server) startMonitor(hash string) {
+	s.lastHash = hash
+	ctx, cancel := context.WithCancel(s.ctx)
+	done := make(chan struct{})
+	s.monitorCancel, s.monitorDone = cancel, done
+
+	// Watch before the monitor runs, so no change goes unnoticed in between
+	changes := watchClipboard(ctx, s.clipboard)
+	go func() {
+		defer close(done)
+		s.monitor(ctx, changes)
+	}()
+}
+
+// Cancel the clipboard monitor and return a channel closed once it has
+// exited. The caller must hold s.mu.
+func (s *Server) stopMonitor() <-chan struct{} {
+	done := s.monitorDone
+	if s.monitorCancel != nil {
+		s.monitorCancel()
+	}
+	s.monitorCancel, s.monitorDone = nil, nil
+	if done == nil {
+		done = make(chan struct{})
+		close(done)
+	}
+	return done
+}
+
+// Apply a clip received from a device if it is newer than the clip the
+// clipboard holds. Returns false if it lost, and any error writing it; a clip
+// that won is relayed even if this PC cannot hold it.
+func (s *Server) applyRemote(msg *Message, data []byte) (bool, error) {
+	s.clipMu.Lock()
+	defer s.clipMu.Unlock()
+
+	// Something copied here that the monitor has not picked up yet competes too
+	s.checkClipboardLocked()
+
+	version := s.remoteVersion(msg)
+	if !version.newerThan(s.current) {
+		fmt.Printf("[INFO] Ignoring clip %s, the clipboard holds newer clip %s\n", version, s.current)
+		return false, nil
+	}
+	s.current, s.currentID = version, msg.ID
+	return true, s.writeClipboardLocked(msg.MIME, data)
+}
+
+// Version of a received clip, merging its clock into ours. Clips without a
+// clock, or stamped implausibly far ahead, are stamped on arrival instead.
+// The caller must hold s.clipMu.
+func (s *Server) remoteVersion(msg *Message) clipVersion {
+	if msg.Clock == nil || s.clock.tooFarAhead(*msg.Clock) {
+		if msg.Clock != nil {
+			fmt.Printf("[WARN] Clip from %s is stamped %s, its clock is too far ahead\n", msg.Origin, msg.Clock)
+		}
+		stamp := s.clock.Now()
+		msg.Clock = &stamp
+	} else {
+		s.clock.Update(*msg.Clock)
+	}
+	return clipVersion{Clock: *msg.Clock, Origin: msg.Origin}
+}
+
+// Write a clip from the PC's history back to the clipboard and send it out as
+// a new local copy. While sync is paused or the server is stopped only the
+// local clipboard changes.
+func (s *Server) restoreClip(mime string, data []byte) error {
+	s.clipMu.Lock()
+	defer s.clipMu.Unlock()
+
+	if err := s.writeClipboardLocked(mime, data); err != nil {
+		return err
+	}
+	if !s.syncing() {
+		s.currentID = "" // Versioned when it is next sent, like the initial content
+		return nil
+	}
+	s.publishLocal(mime, data, contentHash(mime, data))
+	return nil
+}
+
+// Stamp a clip copied on this PC and send it to every device. A local copy is
+// the latest event this node knows of, so it always becomes the current
+// version. The caller must hold s.clipMu.
+func (s *Server) publishLocal(mime string, data []byte, hash string) {
+	msg := newClipMessage(mime, data, localDeviceID)
+	stamp := s.clock.Now()
+	msg.Clock = &stamp
+	s.current, s.currentID = clipVersion{Clock: stamp, Origin: localDeviceID}, msg.ID
+	s.echoes.record(msg.ID, hash)
+	s.distribute(msg, hash, nil)
+}
+
+// Write a clip to the local clipboard and remember what the clipboard now
+// holds, so the monitor does not send it out again. Backends may re-encode
+// images, so the content is read back rather than hashed as written. The
+// caller must hold s.clipMu.
+func (s *Server) writeClipboardLocked(mime string, data []byte) error {
+	var err error
+	if mime == mimeText {
+		err = s.clipboard.WriteText(data)
+	} else {
+		err = s.clipboard.WriteImage(data)
+	}
+	if err != nil {
+		return err
+	}
+	s.setLastHash(contentHash(s.readClipboard()))
+	return nil
+}
+
+// Send a clip to every device except the source and remember who got it,
+// so the clip is not accepted back from them. source is nil for clips copied
+// on this PC.
+func (s *Server) distribute(msg *Message, hash string, source *client) {
+	var sourceConn *websocket.Conn
+	if source != nil {
+		sourceConn = source.conn
+	}
+	recipients := s.broadcastClipboard(msg, hash, sourceConn)
+	var devices []string
+	for _, r := range recipients {
+		if !r.queued {
+			devices = append(devices, r.echoKey)
+		}
+	}
+	s.echoes.delivered(hash, devices)
+	s.deliveries.track(msg, source, recipients)
+}
+
+// Record the hash of clipboard content if it differs from the last one,
+// reporting whether it did
+func (s *Server) seen(hash string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hash == s.lastHash {
+		return false
+	}
+	s.lastHash = hash
+	return true
+}
+
+func (s *Server) lastSeen() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastHash
+}
+
+func (s *Server) setLastHash(hash string) {
+	s.mu.Lock()
+	s.lastHash = hash
+	s.mu.Unlock()
+}
+
+// Whether clips should be exchanged right now
+func (s *Server) syncing() bool {
+	return s.State() == stateRunning
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
@@ -0,0 +1,1911 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Start from a clean configuration and pairing store in a temporary
+// directory, serving plain WebSocket on a free loopback port
+func newTestServer(t *testing.T) (*Server, *memoryClipboard) {
+	t.Helper()
+
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("AppData", dir)
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config = defaultConfig()
+	config.Port = 0
+	config.BindAddress = "127.0.0.1"
+	config.SaveDir = t.TempDir()
+	config.Plain = true
+	config.Headless = true
+	notificationsEnabled.Store(false)
+
+	pairingMutex.Lock()
+	pairing = deviceStore{}
+	pairingMutex.Unlock()
+	if err := loadPairedDevices(); err != nil {
+		t.Fatal(err)
+	}
+
+	cb := newMemoryClipboard()
+	s := newServer(cb)
+	t.Cleanup(func() {
+		if s.State() != stateStopped {
+			s.Stop()
+		}
+	})
+	return s, cb
+}
+
+// A paired test device. Messages are read in the background because a
+// timed out read leaves a gorilla connection unusable.
+type testDevice struct {
+	conn     *websocket.Conn
+	received chan *Message
+	acks     chan TransferAck // Transfer acks, kept apart from other messages
+	receipts chan Receipt     // Delivery receipts, likewise
+	chunks   chan []byte      // Binary frames
+	readErr  error            // Why reading stopped, set before received is closed
+	mute     atomic.Bool      // Stop answering pings, like a phone that left the network
+
+	// Credential from the welcome, to connect again as the same device
+	id, key string
+	version int
+	welcome Welcome
+
+	// Client side of end-to-end encryption, nil for unencrypted devices
+	encKey  []byte
+	session *session
+}
+
+// Connect and pair a device with a fresh pairing token
+func dialPaired(t *testing.T, s *Server) *testDevice {
+	t.Helper()
+	return dialPairedVersion(t, s, protocolVersion)
+}
+
+// Connect and pair a device that speaks at most the given protocol version
+func dialPairedVersion(t *testing.T, s *Server, version int) *testDevice {
+	t.Helper()
+	token, _ := newPairingToken()
+	d := dialDevice(t, fmt.Sprintf("ws://%s/ws?pair=%s", s.Addr(), token), Hello{MaxVersion: version})
+	d.version = version
+	return d
+}
+
+// Connect again as a device paired before
+func (d *testDevice) reconnect(t *testing.T, s *Server) *testDevice {
+	t.Helper()
+	hello := Hello{MaxVersion: d.version, DeviceID: d.id, DeviceKey: d.key}
+	if d.encKey != nil {
+		hello.SessionNonce = newSessionNonce()
+	}
+	again := dialDevice(t, fmt.Sprintf("ws://%s/ws", s.Addr()), hello)
+	again.id, again.key, again.version = d.id, d.key, d.version
+	if d.encKey != nil {
+		again.startSession(t, d.encKey, hello.SessionNonce)
+	}
+	return again
+}
+
+// Connect and pair a device that agrees an encryption key with the server,
+// presenting the pairing token in its hello
+func dialEncrypted(t *testing.T, s *Server) *testDevice {
+	t.Helper()
+	priv, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, secret := newPairingToken()
+	hello := Hello{
+		MaxVersion:   protocolVersion,
+		PairingToken: token,
+		PublicKey:    base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()),
+		SessionNonce: newSessionNonce(),
+	}
+	d := dialDevice(t, fmt.Sprintf("ws://%s/ws", s.Addr()), hello)
+	d.version = protocolVersion
+
+	raw, err := base64.StdEncoding.DecodeString(d.welcome.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.startSession(t, derivePairingKey(shared, secret, priv.PublicKey().Bytes(), raw), hello.SessionNonce)
+	return d
+}
+
+// Derive the client's half of the session the welcome started
+func (d *testDevice) startSession(t *testing.T, key []byte, clientNonce string) {
+	t.Helper()
+	sess, err := newSession(key, clientNonce, d.welcome.SessionNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server's session seen from the other end
+	sess.sendAEAD, sess.recvAEAD = sess.recvAEAD, sess.sendAEAD
+	d.encKey, d.session = key, sess
+}
+
+// Next message, decrypted if it was sealed
+func (d *testDevice) nextOpened(t *testing.T, timeout time.Duration) *Message {
+	t.Helper()
+	msg := d.next(timeout)
+	if msg == nil || msg.Enc == "" {
+		return msg
+	}
+	opened, err := d.session.open(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opened
+}
+
+// Connect and complete the handshake with the given hello
+func dialDevice(t *testing.T, url string, hello Hello) *testDevice {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	d := &testDevice{conn: conn, received: make(chan *Message, 16), acks: make(chan TransferAck, 256), receipts: make(chan Receipt, 16), chunks: make(chan []byte, 64)}
+	conn.SetPingHandler(func(data string) error {
+		if !d.mute.Load() {
+			conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		}
+		return nil
+	})
+	go func() {
+		defer close(d.received)
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				d.readErr = err
+				return
+			}
+			if messageType == websocket.BinaryMessage {
+				d.chunks <- data
+				continue
+			}
+			msg, _, err := decodeMessage(data)
+			if err != nil {
+				continue
+			}
+			var ack TransferAck
+			if msg.Type == msgTypeAck && json.Unmarshal(msg.Payload, &ack) == nil {
+				d.acks <- ack
+				continue
+			}
+			var receipt Receipt
+			if msg.Type == msgTypeReceipt && json.Unmarshal(msg.Payload, &receipt) == nil {
+				select {
+				case d.receipts <- receipt:
+				default: // Most tests do not look at receipts
+				}
+				continue
+			}
+			d.received <- msg
+		}
+	}()
+
+	hello.Name = "Test phone"
+	hello.MinVersion = minProtocolVersion
+	hello.ContentTypes = supportedContentTypes
+	d.send(t, newControlMessage(msgTypeHello, hello))
+	msg := d.next(time.Second)
+	if msg == nil || msg.Type != msgTypeWelcome {
+		t.Fatalf("expected a welcome, got %+v", msg)
+	}
+	if err := json.Unmarshal(msg.Payload, &d.welcome); err != nil {
+		t.Fatal(err)
+	}
+	d.id, d.key = d.welcome.DeviceID, d.welcome.DeviceKey
+	return d
+}
+
+// Connect through the URL without ever sending a hello, like an old app
+// speaking the legacy format
+func dialLegacy(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Next legacy frame, waiting long enough for the client to count as legacy
+func readLegacy(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(handshakeGrace + 2*time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func (d *testDevice) send(t *testing.T, msg *Message) {
+	t.Helper()
+	msg = msg.inline()
+	if d.session != nil && sealedType(msg.Type) {
+		var err error
+		if msg, err = d.session.seal(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := encodeMessage(msg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Next message received, nil if nothing arrives in time or the connection closed
+func (d *testDevice) next(timeout time.Duration) *Message {
+	select {
+	case msg := <-d.received:
+		return msg
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// Whether the server closed the connection
+func (d *testDevice) closed(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-d.received:
+			if !ok {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// Next receipt received, failing the test if none arrives in time
+func (d *testDevice) receipt(t *testing.T) Receipt {
+	t.Helper()
+	select {
+	case r := <-d.receipts:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("no receipt arrived")
+		return Receipt{}
+	}
+}
+
+// Send a clip as a chunked transfer, optionally with a wrong checksum
+func (d *testDevice) sendTransfer(t *testing.T, clip *Message, chunkSize int, checksum string) string {
+	t.Helper()
+	data, _ := clip.clipData()
+	id := newMessageID()
+	d.offerTransfer(t, clip, id)
+	d.sendChunks(t, id, data, 0, len(data), chunkSize)
+	d.completeTransfer(t, id, data, checksum)
+	return id
+}
+
+func (d *testDevice) offerTransfer(t *testing.T, clip *Message, id string) {
+	t.Helper()
+	offer := newControlMessage(msgTypeOffer, TransferOffer{Transfer: id, Size: clip.size(), ChunkSize: transferChunkSize})
+	offer.ID, offer.Origin, offer.MIME, offer.Clock = clip.ID, clip.Origin, clip.MIME, clip.Clock
+	d.send(t, offer)
+}
+
+// Send the content between from and to in chunks
+func (d *testDevice) sendChunks(t *testing.T, id string, data []byte, from, to, chunkSize int) {
+	t.Helper()
+	for offset := from; offset < to; offset += chunkSize {
+		header, chunk := chunkHeader(id, int64(offset)), data[offset:min(offset+chunkSize, to)]
+		if d.session != nil {
+			var err error
+			if chunk, err = d.session.sealChunk(header, chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.conn.WriteMessage(websocket.BinaryMessage, append(header, chunk...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (d *testDevice) completeTransfer(t *testing.T, id string, data []byte, checksum string) {
+	t.Helper()
+	if checksum == "" {
+		sum := sha256.Sum256(data)
+		checksum = hex.EncodeToString(sum[:])
+	}
+	d.send(t, newControlMessage(msgTypeComplete, TransferComplete{Transfer: id, SHA256: checksum}))
+}
+
+// Wait for the server to acknowledge the given offset of a transfer
+func (d *testDevice) waitForAck(t *testing.T, id string, offset int64) {
+	t.Helper()
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case ack := <-d.acks:
+			if ack.Transfer == id && ack.Offset == offset {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("no ack of offset %d for transfer %s", offset, id)
+		}
+	}
+}
+
+// Receive a chunked transfer, acknowledging every chunk, and return its
+// offer and content
+func (d *testDevice) receiveTransfer(t *testing.T) (*Message, []byte) {
+	t.Helper()
+	offer, o := d.receiveOffer(t)
+	data := d.receiveChunks(t, o, o.Offset, o.Size)
+
+	complete := d.nextOpened(t, 2*time.Second)
+	var c TransferComplete
+	if complete == nil || complete.Type != msgTypeComplete || json.Unmarshal(complete.Payload, &c) != nil {
+		t.Fatalf("expected a completion, got %+v", complete)
+	}
+	if sum := sha256.Sum256(data); o.Offset == 0 && (c.Transfer != o.Transfer || c.SHA256 != hex.EncodeToString(sum[:])) {
+		t.Fatalf("completion %+v does not match the received content", c)
+	}
+	return offer, data
+}
+
+func (d *testDevice) receiveOffer(t *testing.T) (*Message, TransferOffer) {
+	t.Helper()
+	offer := d.nextOpened(t, 2*time.Second)
+	if offer == nil || offer.Type != msgTypeOffer {
+		t.Fatalf("expected an offer, got %+v", offer)
+	}
+	var o TransferOffer
+	if err := json.Unmarshal(offer.Payload, &o); err != nil {
+		t.Fatal(err)
+	}
+	return offer, o
+}
+
+// Receive the chunks of a transfer from one offset up to another
+func (d *testDevice) receiveChunks(t *testing.T, o TransferOffer, from, to int64) []byte {
+	t.Helper()
+	var data []byte
+	for from+int64(len(data)) < to {
+		select {
+		case frame := <-d.chunks:
+			id, offset, header, chunk, err := parseChunk(frame)
+			if err != nil || id != o.Transfer || offset != from+int64(len(data)) {
+				t.Fatalf("unexpected chunk for %s at %d: %v", id, offset, err)
+			}
+			if d.session != nil {
+				if chunk, err = d.session.openChunk(header, chunk); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data = append(data, chunk...)
+			ack := newControlMessage(msgTypeAck, TransferAck{Transfer: id, Offset: from + int64(len(data))})
+			d.send(t, ack)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("transfer stalled after %d of %d bytes", from+int64(len(data)), to)
+		}
+	}
+	return data
+}
+
+// A PNG large enough to be sent as a chunked transfer
+func largePNG(t *testing.T) []byte {
+	t.Helper()
+	r := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, 400, 400))
+	r.Read(img.Pix)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() <= 2*transferChunkSize {
+		t.Fatalf("test image of %d bytes is too small", buf.Len())
+	}
+	return buf.Bytes()
+}
+
+// Wait for the server to count the given number of connected clients
+func waitForClients(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		clientsMutex.Lock()
+		total := len(clients)
+		clientsMutex.Unlock()
+		if total == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients connected, want %d", total, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Wait for the clipboard to hold the given text
+func waitForText(t *testing.T, cb *memoryClipboard, want string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if text, _ := cb.ReadText(); string(text) == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	text, _ := cb.ReadText()
+	t.Fatalf("clipboard holds %q, want %q", text, want)
+}
+
+func TestServerStateTransitions(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	steps := []struct {
+		name    string
+		do      func() error
+		wantErr bool
+		want    serverState
+	}{
+		{"pause while stopped", s.Pause, true, stateStopped},
+		{"resume while stopped", s.Resume, true, stateStopped},
+		{"stop while stopped", s.Stop, true, stateStopped},
+		{"start", s.Start, false, stateRunning},
+		{"start twice", s.Start, true, stateRunning},
+		{"resume while running", s.Resume, true, stateRunning},
+		{"pause", s.Pause, false, statePaused},
+		{"pause twice", s.Pause, true, statePaused},
+		{"resume", s.Resume, false, stateRunning},
+		{"stop", s.Stop, false, stateStopped},
+		{"restart", s.Start, false, stateRunning},
+		{"pause before stop", s.Pause, false, statePaused},
+		{"stop while paused", s.Stop, false, stateStopped},
+	}
+	for _, step := range steps {
+		err := step.do()
+		if (err != nil) != step.wantErr {
+			t.Fatalf("%s: error %v, want error %v", step.name, err, step.wantErr)
+		}
+		if got := s.State(); got != step.want {
+			t.Fatalf("%s: state %s, want %s", step.name, got, step.want)
+		}
+	}
+}
+
+func TestServerSyncsBothWays(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	device := dialPaired(t, s)
+
+	cb.WriteText([]byte("from pc"))
+	msg := device.next(2 * time.Second)
+	if msg == nil || msg.Type != msgTypeClip {
+		t.Fatalf("expected a clip, got %+v", msg)
+	}
+	if data, _ := msg.clipData(); string(data) != "from pc" {
+		t.Fatalf("received %q, want %q", data, "from pc")
+	}
+
+	device.send(t, newClipMessage(mimeText, []byte("from phone"), "phone"))
+	waitForText(t, cb, "from phone")
+
+	// The clip written for the phone must not be sent back to it
+	if msg := device.next(300 * time.Millisecond); msg != nil {
+		t.Fatalf("clip echoed back to its sender: %+v", msg)
+	}
+}
+
+func TestServerRelaysClipsToOtherDevices(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sender, other := dialPaired(t, s), dialPaired(t, s)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	clips := []*Message{
+		newClipMessage(mimeText, []byte("relayed text"), "sender"),
+		newClipMessage(mimePNG, buf.Bytes(), "sender"),
+	}
+	for _, clip := range clips {
+		sender.send(t, clip)
+
+		msg := other.next(2 * time.Second)
+		if msg == nil {
+			t.Fatalf("%s clip was not relayed", clip.MIME)
+		}
+		if msg.ID != clip.ID || msg.MIME != clip.MIME || msg.Origin != "sender" {
+			t.Fatalf("relayed %+v, want the clip sent as %+v", msg, clip)
+		}
+
+		// Neither the relay nor the clipboard write may reach the sender
+		if msg := sender.next(300 * time.Millisecond); msg != nil {
+			t.Fatalf("%s clip echoed back to its sender: %+v", clip.MIME, msg)
+		}
+		if msg := other.next(100 * time.Millisecond); msg != nil {
+			t.Fatalf("%s clip delivered twice: %+v", clip.MIME, msg)
+		}
+	}
+
+	if image, _ := cb.ReadImage(); !bytes.Equal(image, buf.Bytes()) {
+		t.Fatal("image was not written to the clipboard")
+	}
+}
+
+func TestServerSuppressesEchoesAndDuplicates(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	a, b := dialPaired(t, s), dialPaired(t, s)
+	expectNothing := func(d *testDevice, what string) {
+		t.Helper()
+		if msg := d.next(300 * time.Millisecond); msg != nil {
+			t.Fatalf("%s: unexpected %+v", what, msg)
+		}
+	}
+	expectClip := func(d *testDevice, want string) *Message {
+		t.Helper()
+		msg := d.next(2 * time.Second)
+		if msg == nil {
+			t.Fatalf("expected clip %q", want)
+		}
+		if data, _ := msg.clipData(); string(data) != want {
+			t.Fatalf("received %q, want %q", data, want)
+		}
+		return msg
+	}
+
+	// b's clipboard monitor sends back what it just received, with a new ID
+	a.send(t, newClipMessage(mimeText, []byte("x"), "a"))
+	expectClip(b, "x")
+	b.send(t, newClipMessage(mimeText, []byte("x"), "b"))
+	expectNothing(a, "echo relayed to the original sender")
+
+	// A late echo must not overwrite something copied on the PC since
+	cb.WriteText([]byte("y"))
+	expectClip(a, "y")
+	expectClip(b, "y")
+	b.send(t, newClipMessage(mimeText, []byte("x"), "b"))
+	expectNothing(a, "late echo relayed")
+	time.Sleep(100 * time.Millisecond)
+	if text, _ := cb.ReadText(); string(text) != "y" {
+		t.Fatalf("late echo overwrote the clipboard with %q", text)
+	}
+
+	// The same message arriving over a second path is applied once
+	z := newClipMessage(mimeText, []byte("z"), "a")
+	a.send(t, z)
+	expectClip(b, "z")
+	cb.WriteText([]byte("w"))
+	expectClip(a, "w")
+	expectClip(b, "w")
+	c := dialPaired(t, s)
+	c.send(t, z)
+	expectNothing(a, "duplicate message relayed")
+	if text, _ := cb.ReadText(); string(text) != "w" {
+		t.Fatalf("duplicate message applied, clipboard holds %q", text)
+	}
+
+	// Copying earlier content again on a device that never received it is
+	// not an echo
+	c.send(t, newClipMessage(mimeText, []byte("x"), "c"))
+	waitForText(t, cb, "x")
+	expectClip(a, "x")
+	expectClip(b, "x")
+
+	// Nor is copying it again on a device that copied something else since
+	a.send(t, newClipMessage(mimeText, []byte("p"), "a"))
+	expectClip(b, "p")
+	b.send(t, newClipMessage(mimeText, []byte("q"), "b"))
+	expectClip(a, "q")
+	time.Sleep(10 * time.Millisecond)
+	b.send(t, newClipMessage(mimeText, []byte("p"), "b"))
+	expectClip(a, "p")
+	waitForText(t, cb, "p")
+}
+
+func TestServerTellsLegacyClientsApart(t *testing.T) {
+	s, cb := newTestServer(t)
+	config.InitialSync = syncNone
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	phone := dialPaired(t, s)
+
+	// Clients that paired through the URL without a hello have no device ID
+	dialURLPaired := func() *websocket.Conn {
+		token, _ := newPairingToken()
+		return dialLegacy(t, fmt.Sprintf("ws://%s/ws?pair=%s", s.Addr(), token))
+	}
+	first := dialURLPaired()
+	time.Sleep(handshakeGrace + 100*time.Millisecond) // Until it counts as a legacy client
+	cb.WriteText([]byte("k"))
+	if got := readLegacy(t, first); got != legacyTextPrefix+"k" {
+		t.Fatalf("received %q", got)
+	}
+	if msg := phone.next(2 * time.Second); msg == nil {
+		t.Fatal("expected the copy on the phone")
+	}
+	phone.send(t, newClipMessage(mimeText, []byte("m"), phone.id))
+	waitForText(t, cb, "m")
+
+	// What the first was sent is no echo when another one copies it
+	second := dialURLPaired()
+	waitForClients(t, 3)
+	if err := second.WriteMessage(websocket.TextMessage, []byte(legacyTextPrefix+"k")); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, cb, "k")
+}
+
+func TestServerReportsDelivery(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sender, tablet := dialPaired(t, s), dialPaired(t, s)
+	older := dialPairedVersion(t, s, transferVersion)
+
+	clip := newClipMessage(mimeText, []byte("did it arrive?"), "sender")
+	sender.send(t, clip)
+
+	r := sender.receipt(t)
+	if r.Clip != clip.ID || r.Status != receiptApplied || r.Device != localDeviceID {
+		t.Fatalf("PC reported %+v, want the clip applied", r)
+	}
+
+	// Devices report back, the sender learns about each of them
+	if msg := tablet.next(2 * time.Second); msg == nil || msg.ID != clip.ID {
+		t.Fatalf("clip was not relayed, got %+v", msg)
+	}
+	if msg := older.next(2 * time.Second); msg == nil || msg.ID != clip.ID {
+		t.Fatalf("clip was not relayed to the older device, got %+v", msg)
+	}
+	tablet.send(t, newControlMessage(msgTypeReceipt, Receipt{Clip: clip.ID, Status: receiptFailed, Reason: "clipboard is locked"}))
+	r = sender.receipt(t)
+	if r.Clip != clip.ID || r.Status != receiptFailed || r.Reason != "clipboard is locked" || r.Device != tablet.id {
+		t.Fatalf("forwarded %+v, want the tablet's failure", r)
+	}
+
+	// A clip that lost to a newer one is reported as superseded
+	stale := newClipMessage(mimeText, []byte("copied earlier"), "sender")
+	stale.Clock = &Timestamp{Wall: 1}
+	sender.send(t, stale)
+	if r := sender.receipt(t); r.Clip != stale.ID || r.Status != receiptSuperseded {
+		t.Fatalf("PC reported %+v for a stale clip, want superseded", r)
+	}
+
+	// So is an echo of a clip the PC has replaced since
+	cb.WriteText([]byte("copied on the PC"))
+	if msg := tablet.next(2 * time.Second); msg == nil {
+		t.Fatal("expected the PC's copy on the tablet")
+	}
+	echo := newClipMessage(mimeText, []byte("did it arrive?"), "tablet")
+	tablet.send(t, echo)
+	if r := tablet.receipt(t); r.Clip != echo.ID || r.Status != receiptSuperseded {
+		t.Fatalf("PC reported %+v for an echo, want superseded", r)
+	}
+}
+
+func TestDeliverySummary(t *testing.T) {
+	d := &delivery{results: []deliveryResult{
+		{name: "Pixel 8", status: receiptApplied},
+		{name: "Tablet", status: receiptFailed},
+	}}
+	if got, want := d.summary(), "Delivered to Pixel 8, failed on Tablet"; got != want {
+		t.Fatalf("summary %q, want %q", got, want)
+	}
+	if d.delivered() {
+		t.Fatal("a failed device counts as delivered")
+	}
+
+	d.results = []deliveryResult{
+		{name: "Old phone", status: deliverySent},
+		{name: "Laptop", status: deliveryTimeout},
+		{name: "Pixel 8", status: receiptApplied},
+		{name: "Tablet", status: receiptApplied},
+	}
+	if got, want := d.summary(), "Delivered to Pixel 8, Tablet, no answer from Laptop, sent to Old phone"; got != want {
+		t.Fatalf("summary %q, want %q", got, want)
+	}
+}
+
+func TestServerResolvesConcurrentCopies(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	a, b := dialPaired(t, s), dialPaired(t, s)
+
+	cb.WriteText([]byte("copied on pc"))
+	pcClip := a.next(2 * time.Second)
+	if pcClip == nil || pcClip.Clock == nil || pcClip.Origin != localDeviceID {
+		t.Fatalf("expected a stamped clip from the PC, got %+v", pcClip)
+	}
+	b.next(2 * time.Second)
+
+	// Copied on a device before it received the PC's clip: it loses everywhere
+	older := newClipMessage(mimeText, []byte("copied earlier"), "a")
+	older.Clock = &Timestamp{Wall: pcClip.Clock.Wall - 1}
+	a.send(t, older)
+	if msg := b.next(300 * time.Millisecond); msg != nil {
+		t.Fatalf("older clip relayed: %+v", msg)
+	}
+	if text, _ := cb.ReadText(); string(text) != "copied on pc" {
+		t.Fatalf("older clip applied, clipboard holds %q", text)
+	}
+
+	// Same clock, the origin decides
+	tie := newClipMessage(mimeText, []byte("same time"), "a")
+	tie.Clock = pcClip.Clock
+	a.send(t, tie)
+	if localDeviceID > "a" {
+		if msg := b.next(300 * time.Millisecond); msg != nil {
+			t.Fatalf("tie lost to the PC but was relayed: %+v", msg)
+		}
+	} else {
+		waitForText(t, cb, "same time")
+		b.next(2 * time.Second)
+	}
+
+	// A newer copy wins and is relayed with its clock unchanged
+	newer := newClipMessage(mimeText, []byte("copied later"), "a")
+	newer.Clock = &Timestamp{Wall: pcClip.Clock.Wall + 1}
+	a.send(t, newer)
+	waitForText(t, cb, "copied later")
+	msg := b.next(2 * time.Second)
+	if msg == nil || msg.ID != newer.ID || msg.Clock == nil || *msg.Clock != *newer.Clock {
+		t.Fatalf("relayed %+v, want the newer clip with its clock", msg)
+	}
+
+	// A clip without a clock counts as copied on arrival
+	unstamped := newClipMessage(mimeText, []byte("legacy client"), "b")
+	b.send(t, unstamped)
+	waitForText(t, cb, "legacy client")
+	msg = a.next(2 * time.Second)
+	if msg == nil || msg.Clock == nil || msg.Clock.compare(*newer.Clock) <= 0 {
+		t.Fatalf("unstamped clip relayed as %+v, want a clock after %s", msg, newer.Clock)
+	}
+}
+
+func TestServerTransfersLargeClips(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sender, other := dialPaired(t, s), dialPaired(t, s)
+	older := dialPairedVersion(t, s, 1)
+
+	img := largePNG(t)
+	clip := newClipMessage(mimePNG, img, "sender")
+	sender.sendTransfer(t, clip, 100<<10, "")
+
+	offer, data := other.receiveTransfer(t)
+	if offer.ID != clip.ID || offer.Origin != "sender" || offer.MIME != mimePNG {
+		t.Fatalf("relayed offer %+v does not describe the clip %+v", offer, clip)
+	}
+	if !bytes.Equal(data, img) {
+		t.Fatal("relayed content differs from the image sent")
+	}
+
+	// Clients that do not speak transfers get the clip inline
+	msg := older.next(2 * time.Second)
+	if msg == nil || msg.Type != msgTypeClip {
+		t.Fatalf("expected an inline clip, got %+v", msg)
+	}
+	if inline, _ := msg.clipData(); !bytes.Equal(inline, img) {
+		t.Fatal("inline content differs from the image sent")
+	}
+	if got, _ := cb.ReadImage(); !bytes.Equal(got, img) {
+		t.Fatal("image was not written to the clipboard")
+	}
+
+	// Large copies on the PC go out as transfers too
+	copied := bytes.Clone(img)
+	copied[len(copied)-1] ^= 0xff
+	cb.WriteImage(copied)
+	if _, data := sender.receiveTransfer(t); !bytes.Equal(data, copied) {
+		t.Fatal("PC copy arrived with different content")
+	}
+}
+
+func TestServerRejectsCorruptTransfers(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sender, other := dialPaired(t, s), dialPaired(t, s)
+	cb.WriteText([]byte("before"))
+	sender.next(2 * time.Second)
+	other.next(2 * time.Second)
+
+	id := sender.sendTransfer(t, newClipMessage(mimePNG, largePNG(t), "sender"), transferChunkSize, strings.Repeat("0", 64))
+	msg := sender.next(2 * time.Second)
+	var abort TransferAbort
+	if msg == nil || msg.Type != msgTypeAbort || json.Unmarshal(msg.Payload, &abort) != nil || abort.Transfer != id {
+		t.Fatalf("expected an abort of transfer %s, got %+v", id, msg)
+	}
+	if msg := other.next(300 * time.Millisecond); msg != nil {
+		t.Fatalf("corrupt transfer relayed: %+v", msg)
+	}
+	if text, _ := cb.ReadText(); string(text) != "before" {
+		t.Fatalf("corrupt transfer changed the clipboard to %q", text)
+	}
+}
+
+func TestServerResumesIncomingTransfers(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sender, other := dialPaired(t, s), dialPaired(t, s)
+
+	img := largePNG(t)
+	clip := newClipMessage(mimePNG, img, "sender")
+	id := newMessageID()
+	const chunkSize = 100 << 10
+
+	// The connection drops after two chunks
+	sender.offerTransfer(t, clip, id)
+	sender.sendChunks(t, id, img, 0, 2*chunkSize, chunkSize)
+	sender.waitForAck(t, id, 2*chunkSize)
+	sender.conn.Close()
+
+	// The offer on the new connection is answered with where to continue. The
+	// device resends a chunk that already arrived, as if it missed the ack.
+	again := sender.reconnect(t, s)
+	again.offerTransfer(t, clip, id)
+	again.waitForAck(t, id, 2*chunkSize)
+	again.sendChunks(t, id, img, chunkSize, len(img), chunkSize)
+	again.completeTransfer(t, id, img, "")
+
+	if _, data := other.receiveTransfer(t); !bytes.Equal(data, img) {
+		t.Fatal("resumed transfer relayed with different content")
+	}
+	if got, _ := cb.ReadImage(); !bytes.Equal(got, img) {
+		t.Fatal("resumed image was not written to the clipboard")
+	}
+}
+
+func TestServerResumesOutgoingTransfers(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	device := dialPaired(t, s)
+
+	img := largePNG(t)
+	cb.WriteImage(img)
+
+	// Only the first chunk arrives before the connection drops
+	_, offer := device.receiveOffer(t)
+	first := device.receiveChunks(t, offer, 0, transferChunkSize)
+	time.Sleep(50 * time.Millisecond) // Let the server read the ack
+	device.conn.Close()
+
+	again := device.reconnect(t, s)
+	resumed, o := again.receiveOffer(t)
+	if o.Transfer != offer.Transfer || o.Offset != transferChunkSize {
+		t.Fatalf("resumed offer %+v, want transfer %s from offset %d", o, offer.Transfer, transferChunkSize)
+	}
+	if resumed.ID == "" || resumed.MIME != mimePNG {
+		t.Fatalf("resumed offer lost the clip envelope: %+v", resumed)
+	}
+	rest := again.receiveChunks(t, o, o.Offset, o.Size)
+	if !bytes.Equal(append(first, rest...), img) {
+		t.Fatal("resumed transfer does not add up to the image")
+	}
+	if msg := again.next(2 * time.Second); msg == nil || msg.Type != msgTypeComplete {
+		t.Fatalf("expected a completion, got %+v", msg)
+	}
+}
+
+func TestServerLimitsParkedTransfers(t *testing.T) {
+	s, _ := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sender := dialPaired(t, s)
+	img := largePNG(t)
+	clip := newClipMessage(mimePNG, img, "sender")
+
+	// Each connection starts transfers and drops before finishing them
+	var ids []string
+	for range maxIncomingTransfers {
+		id := newMessageID()
+		sender.offerTransfer(t, clip, id)
+		sender.waitForAck(t, id, 0)
+		ids = append(ids, id)
+		sender.conn.Close()
+		sender = sender.reconnect(t, s)
+	}
+
+	id := newMessageID()
+	sender.offerTransfer(t, clip, id)
+	msg := sender.next(2 * time.Second)
+	var abort TransferAbort
+	if msg == nil || msg.Type != msgTypeAbort || json.Unmarshal(msg.Payload, &abort) != nil || abort.Transfer != id {
+		t.Fatalf("expected the new transfer to be refused, got %+v", msg)
+	}
+
+	// The kept ones can still be resumed
+	sender.offerTransfer(t, clip, ids[0])
+	sender.waitForAck(t, ids[0], 0)
+}
+
+func TestServerForgetsAbortedOutgoingTransfers(t *testing.T) {
+	s, cb := newTestServer(t)
+	config.InitialSync = syncNone
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	device := dialPaired(t, s)
+	cb.WriteImage(largePNG(t))
+
+	_, offer := device.receiveOffer(t)
+	device.receiveChunks(t, offer, 0, transferChunkSize)
+	device.send(t, newControlMessage(msgTypeAbort, TransferAbort{Transfer: offer.Transfer, Reason: "no space left"}))
+	time.Sleep(50 * time.Millisecond) // Let the server read the abort
+	device.conn.Close()
+
+	again := device.reconnect(t, s)
+	if msg := again.next(300 * time.Millisecond); msg != nil {
+		t.Fatalf("aborted transfer was resumed: %+v", msg)
+	}
+}
+
+func TestServerDropsTransfersAfterGrace(t *testing.T) {
+	s, _ := newTestServer(t)
+	config.TransferGrace = Duration(100 * time.Millisecond)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sender := dialPaired(t, s)
+
+	img := largePNG(t)
+	clip := newClipMessage(mimePNG, img, "sender")
+	id := newMessageID()
+	sender.offerTransfer(t, clip, id)
+	sender.sendChunks(t, id, img, 0, transferChunkSize, transferChunkSize)
+	sender.waitForAck(t, id, transferChunkSize)
+	sender.conn.Close()
+	time.Sleep(300 * time.Millisecond)
+
+	// The transfer is gone, so the offer starts it over
+	again := sender.reconnect(t, s)
+	again.offerTransfer(t, clip, id)
+	again.waitForAck(t, id, 0)
+}
+
+func TestServerEvictsUnresponsiveDevices(t *testing.T) {
+	s, _ := newTestServer(t)
+	config.PingInterval = Duration(50 * time.Millisecond)
+	config.PongTimeout = Duration(100 * time.Millisecond)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	alive, gone := dialPaired(t, s), dialPaired(t, s)
+
+	gone.mute.Store(true)
+	if !gone.closed(2 * time.Second) {
+		t.Fatal("device that stopped answering pings is still connected")
+	}
+	clientsMutex.Lock()
+	total := len(clients)
+	clientsMutex.Unlock()
+	if total != 1 {
+		t.Fatalf("%d clients after eviction, want 1", total)
+	}
+
+	// Several ping rounds later the device that answers is still there
+	if alive.closed(500 * time.Millisecond) {
+		t.Fatalf("responsive device was disconnected: %v", alive.readErr)
+	}
+}
+
+func TestServerKeepsClipsForOfflineDevices(t *testing.T) {
+	tests := []struct {
+		mode  string
+		limit int
+		want  []string
+	}{
+		{offlineLatest, 10, []string{"third"}},
+		{offlineAll, 2, []string{"second", "third"}},
+		{offlineNone, 10, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			s, cb := newTestServer(t)
+			config.OfflineDelivery = tt.mode
+			config.OutboxLimit = tt.limit
+			config.InitialSync = syncNone // Only what the outbox sends
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			phone := dialPaired(t, s)
+			phone.conn.Close()
+			waitForClients(t, 0)
+
+			for _, text := range []string{"first", "second", "third"} {
+				cb.WriteText([]byte(text))
+				waitForText(t, cb, text)
+				time.Sleep(50 * time.Millisecond) // Let the monitor pick it up
+			}
+
+			again := phone.reconnect(t, s)
+			for _, want := range tt.want {
+				msg := again.next(2 * time.Second)
+				if msg == nil || msg.Type != msgTypeClip {
+					t.Fatalf("expected the missed clip %q, got %+v", want, msg)
+				}
+				if data, _ := msg.clipData(); string(data) != want {
+					t.Fatalf("received %q, want %q", data, want)
+				}
+			}
+			if msg := again.next(200 * time.Millisecond); msg != nil {
+				t.Fatalf("unexpected message after the missed clips: %+v", msg)
+			}
+		})
+	}
+}
+
+func TestServerFlushesOutboxForURLLogins(t *testing.T) {
+	s, cb := newTestServer(t)
+	config.OfflineDelivery = offlineAll
+	config.InitialSync = syncNone
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	phone := dialPaired(t, s)
+	phone.conn.Close()
+	waitForClients(t, 0)
+	cb.WriteText([]byte("while away"))
+	waitForText(t, cb, "while away")
+	time.Sleep(50 * time.Millisecond) // Let the monitor pick it up
+
+	// A device that logs in through the URL and never says hello gets what
+	// it missed, including clips copied while it could still say hello
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws?device=%s&key=%s", s.Addr(), phone.id, phone.key), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitForClients(t, 1)
+	cb.WriteText([]byte("before hello"))
+	for _, want := range []string{"while away", "before hello"} {
+		conn.SetReadDeadline(time.Now().Add(handshakeGrace + 2*time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != legacyTextPrefix+want {
+			t.Fatalf("received %q, want %q", data, legacyTextPrefix+want)
+		}
+	}
+	if n := len(s.outbox.take(phone.id)); n != 0 {
+		t.Fatalf("%d clips left in the outbox", n)
+	}
+}
+
+func TestOutboxLimits(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.OutboxLimit = 3
+	config.OutboxMaxBytes = 10
+	config.OutboxMaxAge = Duration(time.Hour)
+
+	now := time.Now()
+	item := func(size int, age time.Duration) *outboxItem {
+		return &outboxItem{msg: newClipMessage(mimeText, make([]byte, size), "pc"), queuedAt: now.Add(-age)}
+	}
+	tests := []struct {
+		name  string
+		queue []*outboxItem
+		want  int
+	}{
+		{"within limits", []*outboxItem{item(2, 0), item(2, 0)}, 2},
+		{"too many", []*outboxItem{item(1, 0), item(1, 0), item(1, 0), item(1, 0)}, 3},
+		{"too large", []*outboxItem{item(6, 0), item(3, 0), item(3, 0)}, 2},
+		{"too old", []*outboxItem{item(1, 2*time.Hour), item(1, time.Minute)}, 1},
+	}
+	for _, tt := range tests {
+		got := trimOutbox(tt.queue, now)
+		if len(got) != tt.want {
+			t.Fatalf("%s: kept %d clips, want %d", tt.name, len(got), tt.want)
+		}
+		if tt.want > 0 && got[len(got)-1] != tt.queue[len(tt.queue)-1] {
+			t.Fatalf("%s: the newest clip was dropped", tt.name)
+		}
+	}
+}
+
+func TestServerSyncsDevicesOnConnect(t *testing.T) {
+	t.Run(syncPushLatest, func(t *testing.T) {
+		s, cb := newTestServer(t)
+		cb.WriteText([]byte("already on pc"))
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		phone := dialPaired(t, s)
+		msg := phone.next(2 * time.Second)
+		if msg == nil || msg.Type != msgTypeClip || msg.Clock == nil {
+			t.Fatalf("expected the current clip, got %+v", msg)
+		}
+		if data, _ := msg.clipData(); string(data) != "already on pc" {
+			t.Fatalf("received %q, want %q", data, "already on pc")
+		}
+
+		// Asking again gives the same clip, and nothing is sent to older clients
+		phone.send(t, newControlMessage(msgTypeRequest, nil))
+		again := phone.next(2 * time.Second)
+		if again == nil || again.ID != msg.ID || *again.Clock != *msg.Clock {
+			t.Fatalf("requested clip %+v, want %+v", again, msg)
+		}
+		older := dialPairedVersion(t, s, receiptVersion)
+		older.next(2 * time.Second) // The clip pushed on connecting
+		older.send(t, newControlMessage(msgTypeRequest, nil))
+		if msg := older.next(300 * time.Millisecond); msg != nil {
+			t.Fatalf("request from a version %d client answered with %+v", receiptVersion, msg)
+		}
+	})
+
+	t.Run(syncPullDevice, func(t *testing.T) {
+		s, cb := newTestServer(t)
+		config.InitialSync = syncPullDevice
+		cb.WriteText([]byte("already on pc"))
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		phone := dialPaired(t, s)
+		if msg := phone.next(2 * time.Second); msg == nil || msg.Type != msgTypeRequest {
+			t.Fatalf("expected a request for the phone's clip, got %+v", msg)
+		}
+		phone.send(t, newClipMessage(mimeText, []byte("on the phone"), "phone"))
+		waitForText(t, cb, "on the phone")
+	})
+
+	t.Run(syncNone, func(t *testing.T) {
+		s, cb := newTestServer(t)
+		config.InitialSync = syncNone
+		cb.WriteText([]byte("already on pc"))
+		if err := s.Start(); err != nil {
+			t.Fatal(err)
+		}
+		phone := dialPaired(t, s)
+		if msg := phone.next(300 * time.Millisecond); msg != nil {
+			t.Fatalf("nothing should be sent on connecting, got %+v", msg)
+		}
+	})
+}
+
+// Change a device in the registry the way the local page does
+func updateTestDevice(t *testing.T, id, body string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/devices?id="+id, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handleDevices(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update %s: %d %s", body, rec.Code, rec.Body)
+	}
+}
+
+// The registry entry of a device as the local page lists it
+func testDeviceInfo(t *testing.T, id string) deviceInfo {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleDevices(rec, httptest.NewRequest(http.MethodGet, "/devices", nil))
+	var infos []deviceInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.ID == id {
+			return info
+		}
+	}
+	t.Fatalf("device %s is not listed", id)
+	return deviceInfo{}
+}
+
+func TestServerSendsUnseenCopiesOnce(t *testing.T) {
+	s, cb := newTestServer(t)
+	config.InitialSync = syncNone
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	phone := dialPaired(t, s)
+
+	// A copy the monitor was not told about is picked up by the request and
+	// broadcast, which already reaches the device asking
+	cb.mu.Lock()
+	cb.text = []byte("not seen yet")
+	cb.mu.Unlock()
+	phone.send(t, newControlMessage(msgTypeRequest, nil))
+	msg := phone.next(2 * time.Second)
+	if msg == nil || msg.Type != msgTypeClip {
+		t.Fatalf("expected the current clip, got %+v", msg)
+	}
+	if data, _ := msg.clipData(); string(data) != "not seen yet" {
+		t.Fatalf("received %q", data)
+	}
+	if msg := phone.next(300 * time.Millisecond); msg != nil {
+		t.Fatalf("clip sent twice: %+v", msg)
+	}
+}
+
+func TestServerSyncsLegacyClientsOnConnect(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	cb.WriteText([]byte("on the PC"))
+	waitForText(t, cb, "on the PC")
+
+	// An old app that never says hello still gets the current clip
+	token, _ := newPairingToken()
+	conn := dialLegacy(t, fmt.Sprintf("ws://%s/ws?pair=%s", s.Addr(), token))
+	if got := readLegacy(t, conn); got != legacyTextPrefix+"on the PC" {
+		t.Fatalf("received %q", got)
+	}
+}
+
+func TestServerAppliesDeviceSettings(t *testing.T) {
+	s, cb := newTestServer(t)
+	config.InitialSync = syncNone
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	phone := dialPaired(t, s)
+	phone.send(t, newClipMessage(mimeText, []byte("from phone"), "phone"))
+	waitForText(t, cb, "from phone")
+	phone.receipt(t)
+
+	// A phone that only receives has its clips turned down
+	updateTestDevice(t, phone.id, `{"name": "Work phone", "settings": {"direction": "to-device"}}`)
+	clip := newClipMessage(mimeText, []byte("not taken"), "phone")
+	phone.send(t, clip)
+	if r := phone.receipt(t); r.Clip != clip.ID || r.Status != receiptFailed {
+		t.Fatalf("PC reported %+v, want the clip turned down", r)
+	}
+	if data, _ := cb.ReadText(); string(data) != "from phone" {
+		t.Fatalf("clipboard holds %q after a turned down clip", data)
+	}
+	cb.WriteText([]byte("to phone"))
+	if msg := phone.next(2 * time.Second); msg == nil || msg.Type != msgTypeClip {
+		t.Fatalf("expected the copy on the PC, got %+v", msg)
+	}
+
+	// Only the content types picked for it are sent
+	updateTestDevice(t, phone.id, `{"settings": {"contentTypes": ["image/png"]}}`)
+	cb.WriteText([]byte("text is filtered"))
+	if msg := phone.next(300 * time.Millisecond); msg != nil {
+		t.Fatalf("text sent to a device that only takes images: %+v", msg)
+	}
+
+	// The visit is added to its stats once it disconnects
+	phone.conn.Close()
+	waitForClients(t, 0)
+	deadline := time.Now().Add(2 * time.Second)
+	info := testDeviceInfo(t, phone.id)
+	for info.Stats.ClipsSent == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		info = testDeviceInfo(t, phone.id)
+	}
+	if info.Name != "Work phone" || info.Connected || info.LastSeen.IsZero() {
+		t.Fatalf("registry lists %+v", info)
+	}
+	if info.Stats.ClipsReceived != 1 || info.Stats.ClipsSent != 1 || info.Stats.BytesReceived == 0 || info.Stats.BytesSent == 0 {
+		t.Fatalf("recorded stats %+v", info.Stats)
+	}
+}
+
+// The server side of a connected test device
+func connectedClient(t *testing.T, d *testDevice) *client {
+	t.Helper()
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	for _, c := range clients {
+		if c.deviceID == d.id {
+			return c
+		}
+	}
+	t.Fatalf("device %s is not connected", d.id)
+	return nil
+}
+
+func TestServerDeviceActions(t *testing.T) {
+	s, cb := newTestServer(t)
+	config.InitialSync = syncNone
+	cb.WriteText([]byte("on the pc"))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	phone, tablet := dialPaired(t, s), dialPaired(t, s)
+
+	// The current clip goes to the chosen device only
+	s.pushCurrentClip(connectedClient(t, phone))
+	if msg := phone.next(2 * time.Second); msg == nil || msg.Type != msgTypeClip {
+		t.Fatalf("expected the current clip, got %+v", msg)
+	}
+	if msg := tablet.next(300 * time.Millisecond); msg != nil {
+		t.Fatalf("clip also sent to the tablet: %+v", msg)
+	}
+
+	// A paused device is left out until it is resumed
+	if err := pauseDevice(phone.id, true); err != nil {
+		t.Fatal(err)
+	}
+	cb.WriteText([]byte("while paused"))
+	if msg := tablet.next(2 * time.Second); msg == nil || msg.Type != msgTypeClip {
+		t.Fatalf("expected the copy on the tablet, got %+v", msg)
+	}
+	if msg := phone.next(300 * time.Millisecond); msg != nil {
+		t.Fatalf("clip sent to a paused device: %+v", msg)
+	}
+	if err := pauseDevice(phone.id, false); err != nil {
+		t.Fatal(err)
+	}
+	cb.WriteText([]byte("resumed"))
+	if msg := phone.next(2 * time.Second); msg == nil || msg.Type != msgTypeClip {
+		t.Fatalf("expected the copy after resuming, got %+v", msg)
+	}
+
+	// A disconnected device may come back, a forgotten one may not
+	disconnectClient(connectedClient(t, tablet))
+	if !tablet.closed(2 * time.Second) {
+		t.Fatal("tablet still connected")
+	}
+	tablet.reconnect(t, s)
+	if err := s.forgetDevice(phone.id); err != nil {
+		t.Fatal(err)
+	}
+	if !phone.closed(2 * time.Second) {
+		t.Fatal("forgotten phone still connected")
+	}
+	if authenticateDevice(phone.id, phone.key) != nil {
+		t.Fatal("forgotten phone can still authenticate")
+	}
+	if err := s.forgetDevice(phone.id); err == nil {
+		t.Fatal("forgetting an unknown device succeeded")
+	}
+	waitForClients(t, 1)
+}
+
+func TestServerKeepsEncryptedDevicesEncrypted(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	phone := dialEncrypted(t, s)
+	cb.WriteText([]byte("secret-password"))
+	msg := phone.next(2 * time.Second)
+	if msg == nil || msg.Type != msgTypeClip || msg.Enc != encAESGCM {
+		t.Fatalf("expected a sealed clip, got %+v", msg)
+	}
+	opened, err := phone.session.open(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := opened.clipData(); string(data) != "secret-password" {
+		t.Fatalf("opened %q", data)
+	}
+
+	// Logging in through the URL would skip the session, it is refused
+	url := fmt.Sprintf("ws://%s/ws?device=%s&key=%s", s.Addr(), phone.id, phone.key)
+	if conn, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		conn.Close()
+		t.Fatal("encrypted device logged in through the URL")
+	} else if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("URL login failed with %v, want 401", err)
+	}
+
+	// Nothing sealed is encoded for it without a session
+	clientsMutex.Lock()
+	_, err = encodeFor(&client{deviceID: phone.id}, newClipMessage(mimeText, []byte("secret-password"), localDeviceID))
+	clientsMutex.Unlock()
+	if err == nil {
+		t.Fatal("clip encoded in plaintext for an encrypted device")
+	}
+}
+
+func TestServerEncryptsTransfers(t *testing.T) {
+	s, cb := newTestServer(t)
+	config.InitialSync = syncNone
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	phone, tablet := dialEncrypted(t, s), dialEncrypted(t, s)
+
+	// Sealed offer, chunks and completion from one device reach the PC and
+	// are sealed again for the other
+	img := largePNG(t)
+	clip := newClipMessage(mimePNG, img, phone.id)
+	phone.sendTransfer(t, clip, 100<<10, "")
+	offer, data := tablet.receiveTransfer(t)
+	if offer.ID != clip.ID || !bytes.Equal(data, img) {
+		t.Fatal("relayed transfer differs from the one sent")
+	}
+	if got, _ := cb.ReadImage(); !bytes.Equal(got, img) {
+		t.Fatal("image was not written to the clipboard")
+	}
+
+	// A device that reconnects starts a new session with the same key
+	tablet.conn.Close()
+	waitForClients(t, 1)
+	again := tablet.reconnect(t, s)
+	cb.WriteText([]byte("after reconnecting"))
+	if msg := again.nextOpened(t, 2*time.Second); msg == nil || msg.Type != msgTypeClip {
+		t.Fatalf("expected the copy, got %+v", msg)
+	}
+}
+
+func TestServerAuthenticatesKeyExchange(t *testing.T) {
+	s, _ := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client that sent the QR code's pairing secret back in the URL gave
+	// it away, no key can be agreed from it
+	token, secret := newPairingToken()
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws?pair=%s&ks=%s", s.Addr(), token, secret), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	priv, _ := ecdh.X25519().GenerateKey(crand.Reader)
+	hello := newControlMessage(msgTypeHello, Hello{
+		MaxVersion:   protocolVersion,
+		ContentTypes: supportedContentTypes,
+		PublicKey:    base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()),
+		SessionNonce: newSessionNonce(),
+	})
+	data, _ := encodeMessage(hello, false)
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err = conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refusal ErrorPayload
+	msg, _, _ := decodeMessage(data)
+	if msg == nil || msg.Type != msgTypeError || json.Unmarshal(msg.Payload, &refusal) != nil || refusal.Code != errCodeBadHello {
+		t.Fatalf("expected the key exchange to be refused, got %s", data)
+	}
+}
+
+// Send a single frame on a new connection and return the code of the error
+// the server answers with
+func refusalCode(t *testing.T, url string, frame []byte) string {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refusal ErrorPayload
+	msg, _, _ := decodeMessage(data)
+	if msg == nil || msg.Type != msgTypeError || json.Unmarshal(msg.Payload, &refusal) != nil {
+		t.Fatalf("expected an error, got %s", data)
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("connection stayed open after the refusal")
+	}
+	return refusal.Code
+}
+
+func TestServerRefusesIncompatibleClients(t *testing.T) {
+	s, _ := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Only the newest pairing token is valid, so each case gets its own
+	pairURL := func() string {
+		token, _ := newPairingToken()
+		return fmt.Sprintf("ws://%s/ws?pair=%s", s.Addr(), token)
+	}
+	plainURL := func() string { return fmt.Sprintf("ws://%s/ws", s.Addr()) }
+	hello := func(h Hello) []byte {
+		data, err := encodeMessage(newControlMessage(msgTypeHello, h), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	clip, _ := encodeMessage(newClipMessage(mimeText, []byte("too early"), ""), false)
+
+	tests := []struct {
+		name  string
+		url   func() string
+		frame []byte
+		code  string
+	}{
+		{"too new", pairURL, hello(Hello{MinVersion: protocolVersion + 1, MaxVersion: protocolVersion + 1, ContentTypes: supportedContentTypes}), errCodeUnsupportedVersion},
+		{"no content types", pairURL, hello(Hello{MaxVersion: protocolVersion, ContentTypes: []string{"text/html"}}), errCodeNoContentTypes},
+		{"clip before hello", pairURL, clip, errCodeHandshakeRequired},
+		{"invalid hello", pairURL, []byte(`{"v":4,"type":"hello","payload":"not an object"}`), errCodeBadHello},
+		{"not paired", plainURL, hello(Hello{MaxVersion: protocolVersion, ContentTypes: supportedContentTypes}), errCodeUnauthorized},
+		{"unknown device", plainURL, hello(Hello{MaxVersion: protocolVersion, ContentTypes: supportedContentTypes, DeviceID: "nobody", DeviceKey: "guess"}), errCodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := refusalCode(t, tt.url(), tt.frame); code != tt.code {
+				t.Fatalf("refused with %q, want %q", code, tt.code)
+			}
+		})
+	}
+
+	// An older client is downgraded rather than refused
+	old := dialPairedVersion(t, s, 1)
+	if old.welcome.Version != 1 {
+		t.Fatalf("negotiated v%d with a v1 client", old.welcome.Version)
+	}
+}
+
+func TestServerPairingTokenWorksOnce(t *testing.T) {
+	s, _ := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	token, _ := newPairingToken()
+	url := fmt.Sprintf("ws://%s/ws?pair=%s", s.Addr(), token)
+	phone := dialDevice(t, url, Hello{MaxVersion: protocolVersion})
+	if phone.id == "" || phone.key == "" {
+		t.Fatal("pairing issued no credential")
+	}
+
+	// Someone who saw the QR code cannot pair with it again
+	if conn, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		conn.Close()
+		t.Fatal("used pairing token accepted")
+	} else if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("pairing again failed with %v, want 401", err)
+	}
+	hello, _ := encodeMessage(newControlMessage(msgTypeHello, Hello{MaxVersion: protocolVersion, ContentTypes: supportedContentTypes, PairingToken: token}), false)
+	if code := refusalCode(t, fmt.Sprintf("ws://%s/ws", s.Addr()), hello); code != errCodeUnauthorized {
+		t.Fatalf("used token in a hello refused with %q", code)
+	}
+
+	// The credential keeps working
+	phone.conn.Close()
+	waitForClients(t, 0)
+	phone.reconnect(t, s)
+}
+
+func TestServerRestoresLocallyWhenNotSyncing(t *testing.T) {
+	s, cb := newTestServer(t)
+	config.InitialSync = syncNone
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	phone := dialPaired(t, s)
+
+	if err := s.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.restoreClip(mimeText, []byte("restored while paused")); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, cb, "restored while paused")
+	if msg := phone.next(300 * time.Millisecond); msg != nil {
+		t.Fatalf("restored clip sent while paused: %+v", msg)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.restoreClip(mimeText, []byte("restored while stopped")); err != nil {
+		t.Fatal(err)
+	}
+	waitForText(t, cb, "restored while stopped")
+	if queued := s.outbox.take(phone.id); len(queued) != 0 {
+		t.Fatalf("%d clips queued for the phone while stopped", len(queued))
+	}
+}
+
+func TestLocalPagesCheckHost(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.QRPort = 3000
+
+	handler := localOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		host string
+		want int
+	}{
+		{"localhost:3000", http.StatusOK},
+		{"127.0.0.1:3000", http.StatusOK},
+		{"rebind.example:3000", http.StatusForbidden},
+		{"localhost:8080", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/history", nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("host %q: got %d, want %d", tt.host, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestSendQueueOnlyDropsClips(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.SlowClients = slowClientDrop
+
+	c := &client{send: make(chan frame, 3), done: make(chan struct{})}
+	queue := func(data string, clip bool) bool {
+		clientsMutex.Lock()
+		defer clientsMutex.Unlock()
+		if clip {
+			return c.enqueueClip([]byte(data))
+		}
+		return c.enqueue(websocket.TextMessage, []byte(data))
+	}
+	queued := func() []string {
+		var frames []string
+		for len(c.send) > 0 {
+			frames = append(frames, string((<-c.send).data))
+		}
+		for _, f := range frames {
+			c.send <- frame{messageType: websocket.TextMessage, data: []byte(f), clip: strings.HasPrefix(f, "clip")}
+		}
+		return frames
+	}
+
+	queue("welcome", false)
+	queue("clip 1", true)
+	queue("clip 2", true)
+	if !queue("error", false) {
+		t.Fatal("control frame not queued")
+	}
+	if got := strings.Join(queued(), ", "); got != "welcome, clip 2, error" {
+		t.Fatalf("queue holds %s, want the oldest clip dropped", got)
+	}
+	queue("clip 3", true)
+	queue("close", false)
+	if got := strings.Join(queued(), ", "); got != "welcome, error, close" {
+		t.Fatalf("queue holds %s", got)
+	}
+	if queue("clip 4", true) {
+		t.Fatal("clip queued in place of a control frame")
+	}
+	if got := strings.Join(queued(), ", "); got != "welcome, error, close" {
+		t.Fatalf("queue holds %s, want the control frames kept", got)
+	}
+}
+
+func TestServerPauseStopsSync(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	device := dialPaired(t, s)
+
+	if err := s.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	cb.WriteText([]byte("copied while paused"))
+	if msg := device.next(300 * time.Millisecond); msg != nil {
+		t.Fatalf("clip sent while paused: %+v", msg)
+	}
+	device.send(t, newClipMessage(mimeText, []byte("sent while paused"), "phone"))
+	time.Sleep(100 * time.Millisecond)
+	if text, _ := cb.ReadText(); string(text) != "copied while paused" {
+		t.Fatalf("clipboard changed while paused to %q", text)
+	}
+
+	if err := s.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	cb.WriteText([]byte("after resume"))
+	msg := device.next(2 * time.Second)
+	if msg == nil {
+		t.Fatal("no clip after resume")
+	}
+	if data, _ := msg.clipData(); string(data) != "after resume" {
+		t.Fatalf("received %q after resume", data)
+	}
+}
+
+func TestServerStopDisconnectsClients(t *testing.T) {
+	s, _ := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	device := dialPaired(t, s)
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Stop() }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(stopTimeout + time.Second):
+		t.Fatal("Stop hung with a connected client")
+	}
+
+	if !device.closed(time.Second) {
+		t.Fatal("client still connected after Stop")
+	}
+	if !websocket.IsCloseError(device.readErr, websocket.CloseGoingAway) {
+		t.Fatalf("expected a going away close frame, got %v", device.readErr)
+	}
+	if ce, ok := device.readErr.(*websocket.CloseError); !ok || ce.Text != stopReason {
+		t.Fatalf("expected close reason %q, got %v", stopReason, device.readErr)
+	}
+
+	// Handlers remove their client as they exit
+	deadline := time.Now().Add(time.Second)
+	for {
+		clientsMutex.Lock()
+		remaining := len(clients)
+		clientsMutex.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients left after Stop", remaining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerStopFreesPortAndRestarts(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	addr := s.Addr().String()
+	dialPaired(t, s)
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The port must be free again, both for others and for a restart
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("port still in use after Stop: %v", err)
+	}
+	ln.Close()
+	if _, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil); err == nil {
+		t.Fatal("stopped server still accepts connections")
+	}
+
+	_, port, _ := net.SplitHostPort(addr)
+	config.Port, _ = strconv.Atoi(port)
+	if err := s.Start(); err != nil {
+		t.Fatalf("restart failed: %v", err)
+	}
+	device := dialPaired(t, s)
+	cb.WriteText([]byte("after restart"))
+	msg := device.next(2 * time.Second)
+	if msg == nil {
+		t.Fatal("no clip after restart")
+	}
+	if data, _ := msg.clipData(); string(data) != "after restart" {
+		t.Fatalf("received %q after restart", data)
+	}
+}
+
+// Hammer the server from several goroutines the way tray clicks, devices
+// and the clipboard would, to let the race detector see every path
+func TestServerConcurrentControl(t *testing.T) {
+	s, cb := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	addr := s.Addr().String()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			ops := []func() error{s.Start, s.Pause, s.Resume, s.Stop}
+			for j := 0; j < 25; j++ {
+				ops[r.Intn(len(ops))]()
+				s.State()
+			}
+		}(int64(i))
+	}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				cb.WriteText([]byte(fmt.Sprintf("clip %d-%d", n, j)))
+				time.Sleep(time.Millisecond)
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10; j++ {
+			token, _ := newPairingToken()
+			url := fmt.Sprintf("ws://%s/ws?pair=%s", addr, token)
+			if conn, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+				conn.Close()
+			}
+		}
+	}()
+	wg.Wait()
+
+	switch s.State() {
+	case stateRunning, statePaused:
+		if err := s.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	case stateStopped:
+	default:
+		t.Fatalf("server left in state %s", s.State())
+	}
+	if s.Addr() != nil {
+		t.Fatal("stopped server still reports an address")
+	}
+}
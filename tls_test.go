@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCertificatePersists(t *testing.T) {
+	newTestServer(t)
+	if err := loadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	first := certFingerprint
+	if len(first) != 64 {
+		t.Fatalf("fingerprint %q is not a hex SHA-256", first)
+	}
+
+	// Loaded again after a restart, so pinned devices keep connecting
+	if err := loadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if certFingerprint != first {
+		t.Fatal("certificate changed after a restart")
+	}
+	leaf, err := x509.ParseCertificate(serverCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint(leaf.Raw) != first {
+		t.Fatal("fingerprint does not match the certificate")
+	}
+}
+
+func TestServerServesPinnedTLS(t *testing.T) {
+	s, _ := newTestServer(t)
+	config.Plain = false
+	if err := loadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The QR code carries the fingerprint to pin
+	u, err := url.Parse(pairingURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "wss" || u.Query().Get("fp") != certFingerprint {
+		t.Fatalf("pairing URL %s does not pin the certificate", u)
+	}
+
+	// A device that pins the fingerprint connects without trusting a CA
+	pinned := func(pin string) *websocket.Dialer {
+		return &websocket.Dialer{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 || fingerprint(rawCerts[0]) != pin {
+					return fmt.Errorf("certificate does not match the pinned fingerprint")
+				}
+				return nil
+			},
+		}}
+	}
+	addr := fmt.Sprintf("wss://%s/ws", s.Addr())
+	conn, _, err := pinned(certFingerprint).Dial(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, _, err := pinned(strings.Repeat("0", 64)).Dial(addr, nil); err == nil {
+		t.Fatal("connected with the wrong pin")
+	}
+
+	// Plain WebSocket is not served next to TLS
+	if conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws", s.Addr()), nil); err == nil {
+		conn.Close()
+		t.Fatal("plain connection accepted with TLS on")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Clips larger than this are sent as chunked transfers to clients that speak
+// transferVersion, in chunks of this size
+const transferChunkSize = 256 << 10
+
+// Transfers a client may have in flight at once
+const maxIncomingTransfers = 4
+
+// First byte of a binary frame carrying a transfer chunk
+const chunkFrameKind byte = 1
+
+// TransferOffer is the payload of an offer. The envelope of the offer
+// carries the clip's ID, origin, MIME type and clock.
+type TransferOffer struct {
+	Transfer  string `json:"transfer"`
+	Size      int64  `json:"size"`
+	ChunkSize int    `json:"chunkSize"`
+	Offset    int64  `json:"offset,omitempty"` // Where chunks start when the transfer is resumed
+}
+
+// TransferAck is the payload of an ack, sent by the receiver of a transfer
+// for the offer and every chunk
+type TransferAck struct {
+	Transfer string `json:"transfer"`
+	Offset   int64  `json:"offset"` // Bytes received so far
+}
+
+// TransferComplete is the payload of a complete message
+type TransferComplete struct {
+	Transfer string `json:"transfer"`
+	SHA256   string `json:"sha256"` // Hex digest of the whole content
+}
+
+// TransferAbort is the payload of an abort message
+type TransferAbort struct {
+	Transfer string `json:"transfer"`
+	Reason   string `json:"reason"`
+}
+
+// Header of a chunk frame: the frame kind, the length of the transfer ID,
+// the transfer ID and the chunk's offset as a big endian uint64. The chunk
+// data follows it.
+func chunkHeader(id string, offset int64) []byte {
+	header := make([]byte, 0, 2+len(id)+8)
+	header = append(header, chunkFrameKind, byte(len(id)))
+	header = append(header, id...)
+	return binary.BigEndian.AppendUint64(header, uint64(offset))
+}
+
+// Split a chunk frame into its transfer ID, offset, header and data
+func parseChunk(frame []byte) (id string, offset int64, header, data []byte, err error) {
+	if len(frame) < 2 || frame[0] != chunkFrameKind {
+		return "", 0, nil, nil, fmt.Errorf("not a chunk frame")
+	}
+	end := 2 + int(frame[1]) + 8
+	if frame[1] == 0 || len(frame) < end {
+		return "", 0, nil, nil, fmt.Errorf("truncated chunk header")
+	}
+	id = string(frame[2 : end-8])
+	offset = int64(binary.BigEndian.Uint64(frame[end-8 : end]))
+	return id, offset, frame[:end], frame[end:], nil
+}
+
+// Logs a transfer's progress every quarter
+type transferProgress struct {
+	label string
+	total int64
+	next  int64 // Next percentage to report
+}
+
+func (p *transferProgress) update(done int64) {
+	if p.total == 0 {
+		return
+	}
+	percent := done * 100 / p.total
+	if percent < p.next {
+		return
+	}
+	fmt.Printf("[INFO] %s: %d%% (%d of %d bytes)\n", p.label, percent, done, p.total)
+	p.next = percent/25*25 + 25
+}
+
+// A clip being received in chunks. The content goes to a temporary file as
+// it arrives, so large clips are not held in memory until they are complete.
+// Transfers live in the transferStore, so a device that reconnects can take
+// over a transfer from its previous connection.
+type incomingTransfer struct {
+	mu       sync.Mutex
+	owner    *client     // Connection sending it, nil while its device is away. Written with the store locked too.
+	timer    *time.Timer // Drops the transfer if its device stays away
+	clip     *Message    // Envelope of the clip, from the offer
+	size     int64
+	received int64
+	file     *os.File
+	hash     hash.Hash
+	progress transferProgress
+}
+
+// Delete the file of a transfer that will not complete
+func (t *incomingTransfer) discard() {
+	t.file.Close()
+	os.Remove(t.file.Name())
+}
+
+// Message types of the chunked transfer protocol
+func isTransferType(msgType string) bool {
+	return msgType == msgTypeOffer || msgType == msgTypeComplete || msgType == msgTypeAbort || msgType == msgTypeAck
+}
+
+// Handle an offer, completion, abort or ack from the client. Returns the
+// clip of a transfer that completed, nil otherwise.
+func (c *client) handleTransfer(store *transferStore, msg *Message) *Message {
+	var ref struct {
+		Transfer string `json:"transfer"`
+	}
+	if err := json.Unmarshal(msg.Payload, &ref); err != nil || ref.Transfer == "" || len(ref.Transfer) > 255 {
+		fmt.Printf("[ERROR] Invalid %s message from %s\n", msg.Type, c.displayName())
+		return nil
+	}
+
+	var clip *Message
+	var err error
+	switch msg.Type {
+	case msgTypeOffer:
+		var offer TransferOffer
+		if err = json.Unmarshal(msg.Payload, &offer); err != nil {
+			break
+		}
+		var received int64
+		if received, err = store.start(c, msg, offer); err == nil {
+			// Tells the device where to continue if it is resuming
+			c.ackTransfer(offer.Transfer, received)
+		}
+	case msgTypeComplete:
+		var done TransferComplete
+		if err = json.Unmarshal(msg.Payload, &done); err == nil {
+			clip, err = store.complete(c, done)
+		}
+	case msgTypeAbort:
+		var abort TransferAbort
+		json.Unmarshal(msg.Payload, &abort)
+		fmt.Printf("[INFO] %s aborted transfer %s: %s\n", c.displayName(), abort.Transfer, abort.Reason)
+		store.drop(c, abort.Transfer)
+		store.abandon(c.deviceID, abort.Transfer)
+	case msgTypeAck:
+		var ack TransferAck
+		json.Unmarshal(msg.Payload, &ack)
+		store.ack(c.deviceID, ack.Transfer, ack.Offset)
+	}
+	if err != nil {
+		c.abortTransfer(store, ref.Transfer, err)
+	}
+	return clip
+}
+
+// Append a chunk to its transfer and acknowledge it, or abort the transfer
+func (c *client) receiveChunk(store *transferStore, frame []byte) {
+	id, received, err := store.chunk(c, frame)
+	switch {
+	case err != nil:
+		c.abortTransfer(store, id, err)
+	case id != "":
+		c.ackTransfer(id, received)
+	}
+}
+
+// Tell the client how much of a transfer arrived
+func (c *client) ackTransfer(id string, offset int64) {
+	if err := sendMessage(c, newControlMessage(msgTypeAck, TransferAck{Transfer: id, Offset: offset})); err != nil {
+		fmt.Printf("[ERROR] Failed to acknowledge transfer to %s: %v\n", c.displayName(), err)
+	}
+}
+
+// Tell the client a transfer failed and forget it
+func (c *client) abortTransfer(store *transferStore, id string, err error) {
+	fmt.Printf("[ERROR] Transfer %s from %s failed: %v\n", id, c.displayName(), err)
+	if id == "" {
+		return
+	}
+	store.drop(c, id)
+	abort := newControlMessage(msgTypeAbort, TransferAbort{Transfer: id, Reason: err.Error()})
+	if err := sendMessage(c, abort); err != nil {
+		fmt.Printf("[ERROR] Failed to send abort to %s: %v\n", c.displayName(), err)
+	}
+}
+
+// A clip announced as a chunked transfer, shared by every client it goes to
+type sharedTransfer struct {
+	id       string
+	offer    *Message
+	complete *Message
+	data     []byte
+}
+
+func newSharedTransfer(msg *Message) (*sharedTransfer, error) {
+	data, err := msg.clipData()
+	if err != nil {
+		return nil, err
+	}
+	id := newMessageID()
+	sum := sha256.Sum256(data)
+
+	offer := newControlMessage(msgTypeOffer, TransferOffer{Transfer: id, Size: int64(len(data)), ChunkSize: transferChunkSize})
+	offer.ID, offer.Origin, offer.CreatedAt = msg.ID, msg.Origin, msg.CreatedAt
+	offer.MIME, offer.Clock = msg.MIME, msg.Clock
+	complete := newControlMessage(msgTypeComplete, TransferComplete{Transfer: id, SHA256: hex.EncodeToString(sum[:])})
+	return &sharedTransfer{id: id, offer: offer, complete: complete, data: data}, nil
+}
+
+// Encode the transfer for one client, starting at offset. The caller must
+// hold clientsMutex.
+func (t *sharedTransfer) forClient(c *client, offset int64) (*outgoingTransfer, error) {
+	msg := t.offer
+	if offset > 0 {
+		resumed := *t.offer
+		resumed.Payload, _ = json.Marshal(TransferOffer{Transfer: t.id, Size: int64(len(t.data)), ChunkSize: transferChunkSize, Offset: offset})
+		msg = &resumed
+	}
+	offer, err := encodeFor(c, msg)
+	if err != nil {
+		return nil, err
+	}
+	complete, err := encodeFor(c, t.complete)
+	if err != nil {
+		return nil, err
+	}
+	return &outgoingTransfer{id: t.id, offer: offer, complete: complete, data: t.data, offset: offset, session: c.session}, nil
+}
+
+// A transfer on its way to one client. It takes a single slot in the send
+// queue and the writer streams it as an offer, binary chunks and a completion.
+type outgoingTransfer struct {
+	id       string
+	offer    []byte // Encoded offer and complete messages
+	complete []byte
+	data     []byte
+	offset   int64    // Where to start, past what the client acknowledged before
+	session  *session // Encrypts the chunks, nil for unencrypted clients
+}
+
+// Write a transfer, checking between chunks whether the client is closing
+func (c *client) writeTransfer(t *outgoingTransfer) error {
+	if err := c.write(frame{messageType: websocket.TextMessage, data: t.offer}); err != nil {
+		return err
+	}
+
+	progress := transferProgress{
+		label: "Sending to " + c.displayName(),
+		total: int64(len(t.data)),
+	}
+	for offset := int(t.offset); offset < len(t.data); offset += transferChunkSize {
+		select {
+		case <-c.done:
+			return nil
+		default:
+		}
+
+		end := min(offset+transferChunkSize, len(t.data))
+		if err := c.writeChunk(t, offset, t.data[offset:end]); err != nil {
+			return err
+		}
+		progress.update(int64(end))
+	}
+	return c.write(frame{messageType: websocket.TextMessage, data: t.complete})
+}
+
+// Write one chunk frame, streaming the header and data without joining them
+func (c *client) writeChunk(t *outgoingTransfer, offset int, chunk []byte) error {
+	header := chunkHeader(t.id, int64(offset))
+	if t.session != nil {
+		sealed, err := t.session.sealChunk(header, chunk)
+		if err != nil {
+			return err
+		}
+		chunk = sealed
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(time.Duration(config.WriteTimeout)))
+	w, err := c.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(chunk); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	c.traffic.bytesSent.Add(int64(len(header) + len(chunk)))
+	return nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Transfers in both directions, keyed by device and transfer ID. When a
+// device disconnects its unfinished transfers are kept for
+// config.TransferGrace, so it can resume them after reconnecting.
+type transferStore struct {
+	mu       sync.Mutex
+	incoming map[transferKey]*incomingTransfer
+	outgoing map[string]*pendingSend // By device, only the latest clip is worth resuming
+}
+
+type transferKey struct {
+	device   string
+	transfer string
+}
+
+// The latest transfer sent to a device, kept until the device acknowledged
+// all of it
+type pendingSend struct {
+	shared *sharedTransfer
+	acked  int64
+	owner  *client     // Connection sending it, nil while the device is disconnected
+	timer  *time.Timer // Runs while the device is disconnected
+}
+
+func newTransferStore() *transferStore {
+	return &transferStore{
+		incoming: make(map[transferKey]*incomingTransfer),
+		outgoing: make(map[string]*pendingSend),
+	}
+}
+
+// Start receiving a clip announced by an offer, or take over a transfer the
+// device began on an earlier connection. Returns how much already arrived.
+func (s *transferStore) start(c *client, msg *Message, offer TransferOffer) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := transferKey{device: c.deviceID, transfer: offer.Transfer}
+	if t := s.incoming[key]; t != nil {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.size != offer.Size || t.clip.ID != msg.ID {
+			return 0, fmt.Errorf("offer does not match the transfer started before")
+		}
+		if t.owner != c {
+			fmt.Printf("[INFO] Resuming transfer %s from %s at %d of %d bytes\n", offer.Transfer, c.displayName(), t.received, t.size)
+			t.owner = c
+		}
+		if t.timer != nil {
+			t.timer.Stop()
+			t.timer = nil
+		}
+		return t.received, nil
+	}
+
+	// Transfers kept for resuming count too, or a device that keeps
+	// reconnecting could leave any number of files behind
+	inFlight := 0
+	for key := range s.incoming {
+		if key.device == c.deviceID {
+			inFlight++
+		}
+	}
+	switch {
+	case inFlight >= maxIncomingTransfers:
+		return 0, fmt.Errorf("too many transfers in flight")
+	case offer.Size <= 0 || offer.Size > config.MaxPayload:
+		return 0, fmt.Errorf("transfer of %d bytes exceeds the limit of %d", offer.Size, config.MaxPayload)
+	}
+
+	file, err := os.CreateTemp("", "clipy-transfer-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create transfer file: %v", err)
+	}
+	clip := *msg
+	clip.Type = msgTypeClip
+	clip.Payload = nil
+	s.incoming[key] = &incomingTransfer{
+		owner: c,
+		clip:  &clip,
+		size:  offer.Size,
+		file:  file,
+		hash:  sha256.New(),
+		progress: transferProgress{
+			label: fmt.Sprintf("Receiving %s from %s", msg.MIME, c.displayName()),
+			total: offer.Size,
+		},
+	}
+	return 0, nil
+}
+
+// Append a chunk to its transfer. Chunks continue where the transfer stands;
+// a device that resumed may repeat data that already arrived. Returns the
+// transfer ID and how much of it arrived, or an empty ID for chunks of a
+// transfer that was aborted or taken over by a newer connection.
+func (s *transferStore) chunk(c *client, frame []byte) (string, int64, error) {
+	id, offset, header, data, err := parseChunk(frame)
+	if err != nil {
+		return "", 0, err
+	}
+	s.mu.Lock()
+	t := s.incoming[transferKey{device: c.deviceID, transfer: id}]
+	s.mu.Unlock()
+	if t == nil {
+		return "", 0, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.owner != c {
+		return "", 0, nil
+	}
+	if c.session != nil {
+		if data, err = c.session.openChunk(header, data); err != nil {
+			return id, 0, err
+		}
+	}
+	end := offset + int64(len(data))
+	switch {
+	case offset > t.received:
+		return id, 0, fmt.Errorf("chunk at offset %d, expected %d", offset, t.received)
+	case end > t.size:
+		return id, 0, fmt.Errorf("chunk runs past the offered size of %d bytes", t.size)
+	case end <= t.received:
+		return id, t.received, nil
+	}
+	data = data[t.received-offset:]
+
+	if _, err := t.file.Write(data); err != nil {
+		return id, 0, fmt.Errorf("failed to write transfer file: %v", err)
+	}
+	t.hash.Write(data)
+	t.received += int64(len(data))
+	t.progress.update(t.received)
+	return id, t.received, nil
+}
+
+// Finish a transfer and return the clip it carried, with its content
+func (s *transferStore) complete(c *client, done TransferComplete) (*Message, error) {
+	s.mu.Lock()
+	key := transferKey{device: c.deviceID, transfer: done.Transfer}
+	t := s.incoming[key]
+	if t != nil {
+		t.mu.Lock()
+		if t.owner != c {
+			t.mu.Unlock()
+			t = nil
+		}
+	}
+	if t == nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("completion for unknown transfer %s", done.Transfer)
+	}
+	delete(s.incoming, key)
+	t.mu.Unlock()
+	s.mu.Unlock()
+	defer t.discard()
+
+	if t.received != t.size {
+		return nil, fmt.Errorf("transfer %s ended after %d of %d bytes", done.Transfer, t.received, t.size)
+	}
+	if sum := hex.EncodeToString(t.hash.Sum(nil)); sum != done.SHA256 {
+		return nil, fmt.Errorf("checksum mismatch for transfer %s", done.Transfer)
+	}
+	data, err := os.ReadFile(t.file.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transfer file: %v", err)
+	}
+	t.clip.data = data
+	return t.clip, nil
+}
+
+// Forget a transfer the client is sending and delete its file
+func (s *transferStore) drop(c *client, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := transferKey{device: c.deviceID, transfer: id}
+	if t := s.incoming[key]; t != nil && t.owner == c {
+		delete(s.incoming, key)
+		t.discard()
+	}
+}
+
+// Keep the unfinished transfers of a client that disconnected for the grace
+// period, dropping them if the device does not come back in time
+func (s *transferStore) park(c *client) {
+	grace := time.Duration(config.TransferGrace)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, t := range s.incoming {
+		if t.owner != c {
+			continue
+		}
+		if grace == 0 {
+			delete(s.incoming, key)
+			t.discard()
+			continue
+		}
+		t.mu.Lock()
+		t.owner = nil
+		t.timer = time.AfterFunc(grace, func() { s.expireIncoming(key, t) })
+		fmt.Printf("[INFO] Keeping transfer %s from %s at %d of %d bytes for %s\n", key.transfer, c.displayName(), t.received, t.size, grace)
+		t.mu.Unlock()
+	}
+
+	// A newer connection of the device may have resumed the send already
+	if p := s.outgoing[c.deviceID]; p != nil && p.owner == c {
+		device := c.deviceID
+		p.owner = nil
+		p.timer = time.AfterFunc(grace, func() { s.expireOutgoing(device, p) })
+	}
+}
+
+func (s *transferStore) expireIncoming(key transferKey, t *incomingTransfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.incoming[key] == t && t.owner == nil {
+		delete(s.incoming, key)
+		t.discard()
+		fmt.Printf("[INFO] Dropped transfer %s, its device did not come back in time\n", key.transfer)
+	}
+}
+
+func (s *transferStore) expireOutgoing(device string, p *pendingSend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.outgoing[device] == p {
+		delete(s.outgoing, device)
+	}
+}
+
+// Remember the latest transfer sent to a client's device, replacing an
+// older one
+func (s *transferStore) track(c *client, shared *sharedTransfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old := s.outgoing[c.deviceID]; old != nil && old.timer != nil {
+		old.timer.Stop()
+	}
+	s.outgoing[c.deviceID] = &pendingSend{shared: shared, owner: c}
+}
+
+// Forget a transfer the device aborted, so it is not resumed either
+func (s *transferStore) abandon(device, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p := s.outgoing[device]; p != nil && p.shared.id == id {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		delete(s.outgoing, device)
+	}
+}
+
+// Record how much of a transfer a device has received
+func (s *transferStore) ack(device, id string, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.outgoing[device]
+	if p == nil || p.shared.id != id {
+		return
+	}
+	p.acked = max(p.acked, offset)
+	if p.acked >= int64(len(p.shared.data)) {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		delete(s.outgoing, device)
+	}
+}
+
+// The transfer a reconnected client's device has not received in full, and
+// where to continue it. The client takes the transfer over.
+func (s *transferStore) resumeOutgoing(c *client) (*sharedTransfer, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.outgoing[c.deviceID]
+	if p == nil {
+		return nil, 0
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.owner = c
+	return p.shared, p.acked
+}
+
+// Drop everything, when the server stops
+func (s *transferStore) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, t := range s.incoming {
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+		t.discard()
+		delete(s.incoming, key)
+	}
+	for device, p := range s.outgoing {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		delete(s.outgoing, device)
+	}
+}
+
+// Continue the transfer a reconnected device did not receive in full.
+// Returns the ID of the clip it carries, empty if there is none.
+func (s *Server) resumeTransfer(c *client) string {
+	if c.version < transferVersion || !s.syncing() {
+		return ""
+	}
+	shared, offset := s.transfers.resumeOutgoing(c)
+	if shared == nil {
+		return ""
+	}
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	t, err := shared.forClient(c, offset)
+	if err != nil {
+		fmt.Printf("[ERROR] Failed to encode message: %v\n", err)
+		return ""
+	}
+	if !c.enqueueTransfer(t) {
+		return ""
+	}
+	fmt.Printf("[INFO] Resuming transfer %s to %s at %d of %d bytes\n", shared.id, c.displayName(), offset, len(shared.data))
+	return shared.offer.ID
+}
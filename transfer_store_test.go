@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestParkLeavesResumedSendsAlone(t *testing.T) {
+	shared, err := newSharedTransfer(newClipMessage(mimeText, []byte("large enough"), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTransferStore()
+	t.Cleanup(store.clear)
+	old := &client{deviceID: "phone"}
+	store.track(old, shared)
+
+	// The new connection resumes the send before the old one is cleaned up
+	renewed := &client{deviceID: "phone"}
+	if resumed, _ := store.resumeOutgoing(renewed); resumed != shared {
+		t.Fatal("send not resumed")
+	}
+	store.park(old)
+	if p := store.outgoing["phone"]; p == nil || p.timer != nil || p.owner != renewed {
+		t.Fatalf("parking the old connection took over the resumed send: %+v", p)
+	}
+
+	store.park(renewed)
+	if p := store.outgoing["phone"]; p == nil || p.timer == nil || p.owner != nil {
+		t.Fatalf("send not kept for resuming after its connection left: %+v", p)
+	}
+}
@@ -0,0 +1,197 @@
+//go:build !notray
+
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gen2brain/beeep"
+	"github.com/getlantern/systray"
+)
+
+// The system tray is compiled in, build with -tags notray to leave it out
+const trayAvailable = true
+
+var (
+	statusMenuItem        *systray.MenuItem
+	deliveryMenuItem      *systray.MenuItem // Where the last clip copied on this PC arrived
+	notificationsMenuItem *systray.MenuItem // Menu item to toggle notifications
+)
+
+// Start the system tray
+func startSystemTray() {
+	systray.Run(onReady, onExit)
+}
+
+// Initialize system tray options
+func onReady() {
+	systray.SetIcon(getIcon())
+	systray.SetTitle("Clipboard Sync")
+	systray.SetTooltip("Clipboard Sync Server")
+
+	// Add the new status items
+	statusMenuItem = systray.AddMenuItem("Server Status: Paused", "Displays the current status of the server")
+	setupConnectedDevicesMenu()
+	deliveryMenuItem = systray.AddMenuItem("Last Clip: Not sent yet", "Displays which devices received the last clip copied on this PC")
+
+	// Add menu items. Pausing keeps devices connected, stopping the server
+	// disconnects them and frees the port.
+	serverMenuItem := systray.AddMenuItem("Stop server", "Start or stop the Clipboard Sync server")
+	syncMenuItem := systray.AddMenuItem("Pause sync", "Pause or resume clipboard syncing")
+	openQRMenuItem := systray.AddMenuItem("Open QR", "Open the QR code page in browser")
+
+	// Add the submenu listing recent clipboard items
+	setupRecentClipsMenu()
+
+	// Add the toggle notifications button
+	notificationsMenuItem = systray.AddMenuItem("Disable Notifications", "Toggle notifications on/off")
+
+	// Add the exit button
+	exitMenuItem := systray.AddMenuItem("Exit", "Exit the application")
+
+	// Start the server on first launch
+	startServer()
+
+	// Set the menu items based on server state
+	updateMenuItemsState(serverMenuItem, syncMenuItem)
+
+	// Handle menu item clicks
+	go func() {
+		for {
+			select {
+			case <-serverMenuItem.ClickedCh:
+				fmt.Println("[INFO] Server menu clicked")
+				if server.State() == stateStopped {
+					startServer()
+				} else {
+					stopServer()
+				}
+				updateMenuItemsState(serverMenuItem, syncMenuItem)
+
+			case <-syncMenuItem.ClickedCh:
+				fmt.Println("[INFO] Sync menu clicked")
+				if server.State() == statePaused {
+					resumeSync()
+				} else {
+					pauseSync()
+				}
+				updateMenuItemsState(serverMenuItem, syncMenuItem)
+
+			case <-openQRMenuItem.ClickedCh:
+				fmt.Println("[INFO] Open QR menu clicked")
+				openQRCodePage()
+
+			case <-exitMenuItem.ClickedCh:
+				fmt.Println("[INFO] Exit menu clicked")
+				onExit() // Cleanup and exit the application
+				// os.Exit(0) // Exit the application
+				return
+
+			case <-notificationsMenuItem.ClickedCh:
+				toggleNotifications() // Toggle notifications on or off
+			}
+		}
+	}()
+}
+
+// Function to update the status in the menu
+func updateServerStatus() {
+	switch server.State() {
+	case statePaused:
+		statusMenuItem.SetTitle("Server Status: Paused")
+	case stateRunning:
+		statusMenuItem.SetTitle("Server Status: Running")
+	default:
+		statusMenuItem.SetTitle("Server Status: Stopped")
+	}
+}
+
+// Show where the last clip copied on this PC arrived
+func updateDeliveryStatus(summary string) {
+	if deliveryMenuItem == nil {
+		return // Headless, there is no menu
+	}
+	deliveryMenuItem.SetTitle("Last Clip: " + summary)
+}
+
+// Update the menu items' titles and enabled/disabled state
+func updateMenuItemsState(serverMenuItem, syncMenuItem *systray.MenuItem) {
+	switch server.State() {
+	case statePaused:
+		serverMenuItem.SetTitle("Stop server")
+		syncMenuItem.SetTitle("Resume sync")
+		syncMenuItem.Enable()
+	case stateRunning:
+		serverMenuItem.SetTitle("Stop server")
+		syncMenuItem.SetTitle("Pause sync")
+		syncMenuItem.Enable()
+	default:
+		serverMenuItem.SetTitle("Start server")
+		syncMenuItem.SetTitle("Pause sync")
+		syncMenuItem.Disable() // Nothing to pause while the server is stopped
+	}
+
+	// Update the status and connected devices info
+	updateServerStatus()
+	updateConnectedDevices()
+}
+
+// Icons are compiled in so the binary works from any working directory
+var (
+	//go:embed clipylogo.ico
+	trayIcon []byte
+	//go:embed clipylogo.png
+	notificationIcon []byte
+
+	notificationIconPath string
+	notificationIconOnce sync.Once
+)
+
+// Utility to get tray icon
+func getIcon() []byte {
+	return trayIcon
+}
+
+// Path of the notification icon. beeep only takes a file path, so the
+// embedded icon is written to the config directory once.
+func getNotificationIconPath() string {
+	notificationIconOnce.Do(func() {
+		dir, err := configDir()
+		if err != nil {
+			fmt.Println("[ERROR] Failed to write notification icon:", err)
+			return
+		}
+		path := filepath.Join(dir, "clipylogo.png")
+		if err := os.WriteFile(path, notificationIcon, 0644); err != nil {
+			fmt.Println("[ERROR] Failed to write notification icon:", err)
+			return
+		}
+		notificationIconPath = path
+	})
+	return notificationIconPath
+}
+
+// Show a desktop notification
+func notify(title, message string) {
+	err := beeep.Notify(title, message, getNotificationIconPath())
+	if err != nil {
+		fmt.Printf("[ERROR] Unable to send notification: %v\n", err)
+	}
+}
+
+// Function to toggle notifications on or off
+func toggleNotifications() {
+	if notificationsEnabled.Load() {
+		notificationsEnabled.Store(false)
+		notificationsMenuItem.SetTitle("Enable Notifications")
+		sendNotification("Notifications Disabled", "Notifications have been turned off.")
+	} else {
+		notificationsEnabled.Store(true)
+		notificationsMenuItem.SetTitle("Disable Notifications")
+		sendNotification("Notifications Enabled", "Notifications have been turned on.")
+	}
+}
@@ -0,0 +1,168 @@
+//go:build !notray
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/getlantern/systray"
+)
+
+// Number of devices listed in the "Connected Devices" submenu
+const connectedDevicesCount = 10
+
+// A device listed in the submenu, with the actions for it
+type deviceSlot struct {
+	item       *systray.MenuItem
+	send       *systray.MenuItem
+	pause      *systray.MenuItem
+	disconnect *systray.MenuItem
+	forget     *systray.MenuItem
+	client     *client // Device shown in the slot, nil while hidden
+}
+
+var (
+	connectedDevicesMenuItem *systray.MenuItem
+	connectedDeviceSlots     []*deviceSlot
+	moreDevicesMenuItem      *systray.MenuItem // Counts the devices without a slot
+	connectedDevicesMutex    sync.Mutex        // Guards the client of each slot
+)
+
+// Add the "Connected Devices" submenu. Like "Recent clips" it has a fixed
+// number of slots, shown or hidden as devices connect and disconnect.
+func setupConnectedDevicesMenu() {
+	connectedDevicesMenuItem = systray.AddMenuItem("Connected Devices: none", "Devices connected to this PC")
+
+	for i := 0; i < connectedDevicesCount; i++ {
+		item := connectedDevicesMenuItem.AddSubMenuItem("", "")
+		slot := &deviceSlot{
+			item:       item,
+			send:       item.AddSubMenuItem("Send current clip", "Send what the PC clipboard holds to this device only"),
+			pause:      item.AddSubMenuItem("Pause sync", "Stop exchanging clips with this device only"),
+			disconnect: item.AddSubMenuItem("Disconnect", "Close the connection, the device can connect again"),
+			forget:     item.AddSubMenuItem("Forget device", "Unpair the device, it has to scan the QR code to connect again"),
+		}
+		item.Hide()
+		connectedDeviceSlots = append(connectedDeviceSlots, slot)
+		go slot.handleClicks()
+	}
+	moreDevicesMenuItem = connectedDevicesMenuItem.AddSubMenuItem("", "Only the first devices that connected are listed")
+	moreDevicesMenuItem.Disable()
+	moreDevicesMenuItem.Hide()
+
+	updateConnectedDevices()
+}
+
+// Run the actions clicked in a slot on the device it shows
+func (slot *deviceSlot) handleClicks() {
+	for {
+		var action func(c *client)
+		select {
+		case <-slot.send.ClickedCh:
+			action = server.pushCurrentClip
+		case <-slot.pause.ClickedCh:
+			action = toggleDevicePause
+		case <-slot.disconnect.ClickedCh:
+			action = disconnectClient
+		case <-slot.forget.ClickedCh:
+			action = forgetConnectedDevice
+		}
+
+		connectedDevicesMutex.Lock()
+		c := slot.client
+		connectedDevicesMutex.Unlock()
+
+		if c != nil {
+			action(c)
+		}
+	}
+}
+
+// Pause sync with a device, or resume it if it is paused
+func toggleDevicePause(c *client) {
+	paused := !deviceSettingsFor(c.deviceID).Disabled
+	if err := pauseDevice(c.deviceID, paused); err != nil {
+		fmt.Println("[ERROR] Failed to change device settings:", err)
+		sendNotification("Clipy", "Failed to change device settings.")
+		return
+	}
+	updateConnectedDevices()
+}
+
+// Unpair a device from the menu
+func forgetConnectedDevice(c *client) {
+	if err := server.forgetDevice(c.deviceID); err != nil {
+		fmt.Println("[ERROR] Failed to forget device:", err)
+		sendNotification("Clipy", "Failed to forget device.")
+		return
+	}
+	sendNotification("Device Forgotten", c.displayName()+" has to scan the QR code to connect again")
+}
+
+// Update the submenu from the devices connected now
+func updateConnectedDevices() {
+	if connectedDevicesMenuItem == nil {
+		return // Headless, there is no menu
+	}
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	// The names are in the submenu, the title only counts them so it stays short
+	connected := connectedClients()
+	if len(connected) == 0 {
+		connectedDevicesMenuItem.SetTitle("Connected Devices: none")
+	} else {
+		connectedDevicesMenuItem.SetTitle(fmt.Sprintf("Connected Devices: %d", len(connected)))
+	}
+
+	connectedDevicesMutex.Lock()
+	defer connectedDevicesMutex.Unlock()
+
+	for i, slot := range connectedDeviceSlots {
+		if i >= len(connected) {
+			slot.client = nil
+			slot.item.Hide()
+			continue
+		}
+		c := connected[i]
+		slot.client = c
+
+		// Devices that connect without pairing have nothing to pause or forget
+		paused := deviceSettingsFor(c.deviceID).Disabled
+		title := c.displayName()
+		if paused {
+			title += " (paused)"
+		}
+		slot.item.SetTitle(title)
+		slot.item.SetTooltip("Connected since " + c.connectedAt.Format("Jan 2 15:04:05"))
+		if paused {
+			slot.pause.SetTitle("Resume sync")
+			slot.send.Disable()
+		} else {
+			slot.pause.SetTitle("Pause sync")
+			slot.send.Enable()
+		}
+		if c.deviceID == "" {
+			slot.pause.Disable()
+			slot.forget.Disable()
+		} else {
+			slot.pause.Enable()
+			slot.forget.Enable()
+		}
+		slot.item.Show()
+	}
+
+	if more := len(connected) - len(connectedDeviceSlots); more > 0 {
+		moreDevicesMenuItem.SetTitle(fmt.Sprintf("and %d more", more))
+		moreDevicesMenuItem.Show()
+	} else {
+		moreDevicesMenuItem.Hide()
+	}
+
+	if len(connected) == 0 {
+		connectedDevicesMenuItem.Disable()
+	} else {
+		connectedDevicesMenuItem.Enable()
+	}
+}
@@ -0,0 +1,134 @@
+//go:build !notray
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/getlantern/systray"
+)
+
+const (
+	// Number of history items listed in the "Recent clips" submenu
+	recentClipsCount = 10
+
+	// Longest text preview shown in a menu title, in characters
+	recentClipPreviewLen = 40
+)
+
+var (
+	recentClipsMenu  *systray.MenuItem
+	recentClipSlots  []*systray.MenuItem
+	recentClipIDs    []string // History item shown in each slot
+	recentClipsMutex sync.Mutex
+)
+
+// Add the "Recent clips" submenu. systray cannot remove items, so a fixed
+// number of slots is created and shown or hidden as the history changes.
+func setupRecentClipsMenu() {
+	recentClipsMenu = systray.AddMenuItem("Recent clips", "Copy an earlier clipboard item again")
+	recentClipIDs = make([]string, recentClipsCount)
+
+	for i := 0; i < recentClipsCount; i++ {
+		slot := recentClipsMenu.AddSubMenuItem("", "")
+		slot.Hide()
+		recentClipSlots = append(recentClipSlots, slot)
+
+		go func(i int) {
+			for range slot.ClickedCh {
+				recentClipsMutex.Lock()
+				id := recentClipIDs[i]
+				recentClipsMutex.Unlock()
+
+				if id != "" {
+					restoreHistoryItem(id)
+				}
+			}
+		}(i)
+	}
+
+	onHistoryChanged = refreshRecentClipsMenu
+	refreshRecentClipsMenu()
+}
+
+// Update the submenu from the most recent history items
+func refreshRecentClipsMenu() {
+	if history == nil {
+		recentClipsMenu.Disable()
+		return
+	}
+	items := history.recent(recentClipsCount)
+
+	recentClipsMutex.Lock()
+	defer recentClipsMutex.Unlock()
+
+	for i, slot := range recentClipSlots {
+		if i >= len(items) {
+			recentClipIDs[i] = ""
+			slot.Hide()
+			continue
+		}
+		item := items[i]
+		recentClipIDs[i] = item.ID
+		slot.SetTitle(fmt.Sprintf("%s  (%s)", clipPreview(item), item.OriginName))
+		slot.SetTooltip(fmt.Sprintf("Copied %s from %s", item.CreatedAt.Format("Jan 2 15:04:05"), item.OriginName))
+		slot.Show()
+	}
+
+	if len(items) == 0 {
+		recentClipsMenu.Disable()
+	} else {
+		recentClipsMenu.Enable()
+	}
+}
+
+// Short single-line description of a history item for the menu
+func clipPreview(item *historyItem) string {
+	if item.MIME != mimeText {
+		if item.Width > 0 {
+			return fmt.Sprintf("Image %dx%d", item.Width, item.Height)
+		}
+		return "Image"
+	}
+
+	text := strings.Join(strings.Fields(item.Text), " ")
+	if utf8.RuneCountInString(text) > recentClipPreviewLen {
+		runes := []rune(text)
+		text = string(runes[:recentClipPreviewLen]) + "…"
+	}
+	if text == "" {
+		return "(blank)"
+	}
+	return text
+}
+
+// Put a history item back on the local clipboard and send it to all devices
+func restoreHistoryItem(id string) {
+	item := history.get(id)
+	if item == nil {
+		fmt.Println("[ERROR] History item no longer exists:", id)
+		return
+	}
+	data, err := history.content(item)
+	if err != nil {
+		fmt.Println("[ERROR] Failed to restore clipboard item:", err)
+		sendNotification("Clipy", "Failed to restore clipboard item.")
+		return
+	}
+
+	if err := server.restoreClip(item.MIME, data); err != nil {
+		fmt.Println("[ERROR] Failed to write clipboard item:", err)
+		sendNotification("Clipy", "Failed to restore clipboard item.")
+		return
+	}
+	fmt.Printf("[INFO] Restored clipboard item from history: %s\n", clipPreview(item))
+
+	// Move the item to the top, keeping where it originally came from
+	if _, err := history.add(item.MIME, data, item.Origin, item.OriginName); err != nil {
+		fmt.Println("[ERROR] Failed to update clipboard history:", err)
+	}
+	refreshRecentClipsMenu()
+}
@@ -0,0 +1,23 @@
+//go:build notray
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Built with -tags notray, for machines without a desktop. The binary then
+// does not link the system tray or notification libraries at all.
+const trayAvailable = false
+
+func startSystemTray() {
+	fmt.Println("[ERROR] Built without system tray support, use --headless")
+	os.Exit(1)
+}
+
+func updateConnectedDevices() {}
+
+func updateDeliveryStatus(summary string) {}
+
+func notify(title, message string) {}
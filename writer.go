@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// What happens when a client's send queue is full
+const (
+	slowClientDrop       = "drop"       // Drop the oldest queued clip
+	slowClientDisconnect = "disconnect" // Close the connection
+)
+
+var slowClientPolicies = []string{slowClientDrop, slowClientDisconnect}
+
+// A frame waiting in a client's send queue, or a whole chunked transfer
+type frame struct {
+	messageType int
+	data        []byte
+	transfer    *outgoingTransfer
+	clip        bool // Carries clipboard content, the only frames ever dropped
+}
+
+// Start the goroutine that owns all writes to the connection. Gorilla allows
+// one writer per connection, so nothing else may write to c.conn.
+func (c *client) startWriter() {
+	c.send = make(chan frame, config.SendQueue)
+	c.done = make(chan struct{})
+	c.writerDone = make(chan struct{})
+	go c.writeLoop()
+}
+
+func (c *client) writeLoop() {
+	defer close(c.writerDone)
+	defer c.conn.Close()
+	for {
+		select {
+		case f := <-c.send:
+			var err error
+			if f.transfer != nil {
+				err = c.writeTransfer(f.transfer)
+			} else {
+				err = c.write(f)
+			}
+			if err != nil {
+				fmt.Printf("[ERROR] Failed to send message to %s: %v\n", c.displayName(), err)
+				return
+			}
+		case <-c.done:
+			// Flush what is already queued, such as an error before its close
+			// frame. Transfers are left out, the client could not finish them.
+			for {
+				select {
+				case f := <-c.send:
+					if f.transfer != nil {
+						continue
+					}
+					if err := c.write(f); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// A write that does not finish in time means the client is gone or too slow,
+// the error ends the writer and closes the connection
+func (c *client) write(f frame) error {
+	c.conn.SetWriteDeadline(time.Now().Add(time.Duration(config.WriteTimeout)))
+	if err := c.conn.WriteMessage(f.messageType, f.data); err != nil {
+		return err
+	}
+	c.traffic.bytesSent.Add(int64(len(f.data)))
+	return nil
+}
+
+// Queue a frame without blocking. When the queue is full the slow client
+// policy decides between dropping the oldest clip and disconnecting.
+// Returns false if the frame was not queued. The caller must hold clientsMutex.
+func (c *client) enqueue(messageType int, data []byte) bool {
+	return c.enqueueFrame(frame{messageType: messageType, data: data})
+}
+
+// Queue a clip, which a newer clip may replace if the client falls behind.
+// The caller must hold clientsMutex.
+func (c *client) enqueueClip(data []byte) bool {
+	return c.enqueueFrame(frame{messageType: websocket.TextMessage, data: data, clip: true})
+}
+
+// Queue a chunked transfer of a clip, which takes a single slot. The caller
+// must hold clientsMutex.
+func (c *client) enqueueTransfer(t *outgoingTransfer) bool {
+	return c.enqueueFrame(frame{transfer: t, clip: true})
+}
+
+func (c *client) enqueueFrame(f frame) bool {
+	select {
+	case <-c.done:
+		return false
+	case c.send <- f:
+		return true
+	default:
+	}
+
+	if config.SlowClients == slowClientDisconnect {
+		fmt.Printf("[WARN] Disconnecting %s, its send queue is full\n", c.displayName())
+		c.disconnect()
+		return false
+	}
+
+	// Callers hold clientsMutex, so no other producer can add frames while
+	// the queue is rebuilt without its oldest clip. Control frames, such as
+	// the welcome, errors and close frames, are never dropped.
+	var queued []frame
+	for drained := false; !drained; {
+		select {
+		case q := <-c.send:
+			queued = append(queued, q)
+		default:
+			drained = true
+		}
+	}
+	accepted := true
+	if i := slices.IndexFunc(queued, func(q frame) bool { return q.clip }); i >= 0 {
+		fmt.Printf("[WARN] Send queue of %s is full, dropped the oldest clip\n", c.displayName())
+		queued = append(slices.Delete(queued, i, i+1), f)
+	} else if f.clip {
+		fmt.Printf("[WARN] Send queue of %s is full of other messages, dropped the new clip\n", c.displayName())
+		accepted = false
+	} else {
+		queued = append(queued, f)
+	}
+	for _, q := range queued {
+		select {
+		case c.send <- q:
+		default:
+			// Only control frames are left and the client reads none of them
+			fmt.Printf("[WARN] Disconnecting %s, its send queue is full\n", c.displayName())
+			c.disconnect()
+			return false
+		}
+	}
+	return accepted
+}
+
+// Queue a close frame, sent after everything queued before it. The caller
+// must hold clientsMutex.
+func (c *client) enqueueClose(code int, reason string) {
+	c.enqueue(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+}
+
+// Stop the writer once the queue is flushed, which closes the connection
+func (c *client) shutdown() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// Stop the writer and wait until it has flushed and closed the connection
+func (c *client) finish() {
+	c.shutdown()
+	<-c.writerDone
+}
+
+// Close the connection right away, dropping whatever is still queued
+func (c *client) disconnect() {
+	c.shutdown()
+	c.conn.Close()
+}